@@ -1,52 +1,69 @@
 package main
 
 import (
-	"fmt"
-	"io"
+	"crypto/tls"
+	"flag"
+	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"time"
 
+	"github.com/faceair/clash-speedtest/speedserver"
 	"github.com/faceair/clash-speedtest/speedtester"
 )
 
 func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`<h1>SpeedTest Server</h1>`))
-	})
-
-	http.HandleFunc("/__down", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		byteSize, err := strconv.Atoi(r.URL.Query().Get("bytes"))
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
-		}
-
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=speedtest-%d.bin", byteSize))
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.WriteHeader(http.StatusOK)
+	listen := flag.String("listen", ":8080", "listen address")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enable HTTPS with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	token := flag.String("token", os.Getenv("DOWNLOAD_SERVER_TOKEN"), "require Authorization: Bearer <token> for /__down, /__up, /ws and -stream (default $DOWNLOAD_SERVER_TOKEN)")
+	maxBytes := flag.Int64("max-bytes", 1024*1024*1024, "max bytes per download or upload request or stream, 0 for unlimited")
+	rateLimit := flag.Int("rate-limit", 0, "max requests (or UDP echo packets) per client IP per minute, 0 for unlimited")
+	accessLog := flag.Bool("access-log", true, "log every request")
+	tcpEcho := flag.String("tcp-echo", "", "raw TCP echo listen address (example: :8081), empty to disable")
+	udpEcho := flag.String("udp-echo", "", "UDP echo listen address (example: :8081), empty to disable; limited by -rate-limit per packet, do not expose it publicly without -rate-limit")
+	stream := flag.String("stream", "", "raw TCP stream throughput listen address (example: :8083), empty to disable")
+	payload := flag.String("payload", speedtester.PayloadZero, "payload of /__down: zero, random (incompressible, generated from the seed query parameter)")
+	flag.Parse()
+	if *payload != speedtester.PayloadZero && *payload != speedtester.PayloadRandom {
+		log.Fatalf("invalid -payload value: %s", *payload)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("-tls-cert and -tls-key must be set together")
+	}
 
-		reader := speedtester.NewZeroReader(byteSize)
-		io.Copy(w, reader)
+	handler := speedserver.New(&speedserver.Config{
+		Payload:   *payload,
+		Token:     *token,
+		MaxBytes:  *maxBytes,
+		RateLimit: *rateLimit,
+		AccessLog: *accessLog,
 	})
+	if *stream != "" {
+		go func() { log.Fatal(handler.ServeStream(*stream)) }()
+	}
+	if *tcpEcho != "" {
+		go func() { log.Fatal(speedserver.ServeTCPEcho(*tcpEcho)) }()
+	}
+	if *udpEcho != "" {
+		go func() { log.Fatal(handler.ServeUDPEcho(*udpEcho)) }()
+	}
 
-	http.HandleFunc("/__up", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		io.Copy(io.Discard, r.Body)
-
-		w.WriteHeader(http.StatusOK)
-	})
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
 
-	http.ListenAndServe(":8080", nil)
+	var err error
+	if *tlsCert != "" {
+		server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		log.Printf("speedtest server listening on https://%s", *listen)
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		log.Printf("speedtest server listening on http://%s", *listen)
+		err = server.ListenAndServe()
+	}
+	log.Fatal(err)
 }
@@ -0,0 +1,301 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/faceair/clash-speedtest/history"
+	"github.com/faceair/clash-speedtest/speedtester"
+)
+
+// Config 表示周期测速导出器的配置
+type Config struct {
+	Interval        time.Duration // 两轮测速之间的间隔
+	StashCompatible bool
+	ResolveCountry  bool           // 是否通过出口 IP 查询节点国家
+	History         *history.Store // 非空时记录每一轮的结果
+	Source          string         // 写入历史的配置来源，见 history.RunSource
+}
+
+// nodeState 记录单个节点最近一次的测试结果
+type nodeState struct {
+	result   *speedtester.Result
+	country  string
+	testedAt time.Time
+}
+
+// Exporter 周期性地重新加载并测试代理节点，以 Prometheus 文本格式导出结果
+type Exporter struct {
+	tester *speedtester.SpeedTester
+	config *Config
+
+	mu        sync.RWMutex
+	nodes     map[string]*nodeState // 节点指纹 -> 最近一次结果
+	countries map[string]string     // 节点指纹 -> 国家代码，跨轮次缓存
+	subs      []*speedtester.SubscriptionInfo
+
+	roundsTotal      atomic.Int64
+	roundErrorsTotal atomic.Int64
+	testsTotal       atomic.Int64
+	bytesTotal       atomic.Int64
+	lastRoundMillis  atomic.Int64 // 上一轮耗时（毫秒）
+}
+
+// New 创建一个新的导出器
+func New(tester *speedtester.SpeedTester, config *Config) *Exporter {
+	if config.Interval <= 0 {
+		config.Interval = 5 * time.Minute
+	}
+	return &Exporter{
+		tester:    tester,
+		config:    config,
+		nodes:     make(map[string]*nodeState),
+		countries: make(map[string]string),
+	}
+}
+
+// Run 立即执行一轮测速，之后按间隔重复，直到 ctx 被取消
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.runRound(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Exporter) runRound(ctx context.Context) {
+	start := time.Now()
+	e.roundsTotal.Add(1)
+
+	proxies, err := e.tester.LoadProxies(e.config.StashCompatible)
+	if err != nil {
+		e.roundErrorsTotal.Add(1)
+		log.Printf("周期测速加载代理失败: %v", err)
+		// 不再导出上一轮的节点结果，避免被当作当前状态
+		e.mu.Lock()
+		clear(e.nodes)
+		e.subs = nil
+		e.mu.Unlock()
+		return
+	}
+
+	subs := e.tester.Subscriptions()
+	for _, sub := range subs {
+		for _, warning := range sub.Warnings(start) {
+			log.Printf("订阅 %s: %s", sub.Source, warning)
+		}
+	}
+	e.mu.Lock()
+	e.subs = subs
+	e.mu.Unlock()
+
+	seen := make(map[string]bool, len(proxies))
+	results := make([]*speedtester.Result, 0, len(proxies))
+	e.tester.TestProxiesContext(ctx, proxies, func(result *speedtester.Result) {
+		if result == nil {
+			return
+		}
+		results = append(results, result)
+		e.testsTotal.Add(1)
+		e.bytesTotal.Add(result.BytesSent + result.BytesReceived)
+		seen[result.Fingerprint] = true
+
+		e.mu.Lock()
+		e.nodes[result.Fingerprint] = &nodeState{
+			result:   result,
+			country:  e.countries[result.Fingerprint],
+			testedAt: time.Now(),
+		}
+		e.mu.Unlock()
+	})
+
+	// 退出时本轮结果不完整，不清理节点也不写入历史
+	if ctx.Err() != nil {
+		log.Printf("周期测速已取消: 完成 %d 个节点", len(seen))
+		return
+	}
+
+	if e.config.ResolveCountry {
+		e.resolveCountries()
+	}
+
+	// 移除本轮已不存在的节点
+	e.mu.Lock()
+	for fingerprint := range e.nodes {
+		if !seen[fingerprint] {
+			delete(e.nodes, fingerprint)
+			delete(e.countries, fingerprint)
+		}
+	}
+	e.mu.Unlock()
+
+	if e.config.History != nil {
+		if _, err := e.config.History.SaveRun(start, e.config.Source, results); err != nil {
+			log.Printf("保存测速历史失败: %v", err)
+		}
+	}
+
+	e.lastRoundMillis.Store(time.Since(start).Milliseconds())
+	log.Printf("周期测速完成: %d 个节点，耗时 %v", len(seen), time.Since(start).Round(time.Second))
+}
+
+// resolveCountries 为尚未查询过国家的可用节点查询出口 IP 所在国家
+func (e *Exporter) resolveCountries() {
+	e.mu.RLock()
+	var pending []*speedtester.Result
+	for fingerprint, node := range e.nodes {
+		if node.result.Latency > 0 && e.countries[fingerprint] == "" {
+			pending = append(pending, node.result)
+		}
+	}
+	e.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, 8)
+	for _, result := range pending {
+		wg.Add(1)
+		go func(r *speedtester.Result) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			location, err := e.tester.GetIPLocation(r.Proxy)
+			if err != nil || location.CountryCode == "" {
+				return
+			}
+			e.mu.Lock()
+			e.countries[r.Fingerprint] = location.CountryCode
+			if node, ok := e.nodes[r.Fingerprint]; ok {
+				node.country = location.CountryCode
+			}
+			e.mu.Unlock()
+		}(result)
+	}
+	wg.Wait()
+}
+
+// ServeHTTP 以 Prometheus 文本格式输出指标
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteMetrics(w)
+}
+
+// WriteMetrics 将当前指标写入 w
+func (e *Exporter) WriteMetrics(w io.Writer) {
+	e.mu.RLock()
+	nodes := make([]*nodeState, 0, len(e.nodes))
+	for _, node := range e.nodes {
+		nodes = append(nodes, node)
+	}
+	subs := e.subs
+	e.mu.RUnlock()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].result.ProxyName < nodes[j].result.ProxyName
+	})
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(n *nodeState) float64
+	}{
+		{"clash_speedtest_up", "Whether the node passed the latency test (1) or not (0).", func(n *nodeState) float64 {
+			if n.result.Latency > 0 {
+				return 1
+			}
+			return 0
+		}},
+		{"clash_speedtest_latency_seconds", "Latency of the node.", func(n *nodeState) float64 { return n.result.Latency.Seconds() }},
+		{"clash_speedtest_jitter_seconds", "Latency jitter of the node.", func(n *nodeState) float64 { return n.result.Jitter.Seconds() }},
+		{"clash_speedtest_packet_loss_percent", "Packet loss of the node in percent.", func(n *nodeState) float64 { return n.result.PacketLoss }},
+		{"clash_speedtest_download_bytes_per_second", "Download speed of the node.", func(n *nodeState) float64 { return n.result.DownloadSpeed }},
+		{"clash_speedtest_upload_bytes_per_second", "Upload speed of the node.", func(n *nodeState) float64 { return n.result.UploadSpeed }},
+		{"clash_speedtest_score", "Composite quality score of the node (0-100).", func(n *nodeState) float64 { return n.result.Score }},
+		{"clash_speedtest_last_test_timestamp_seconds", "Unix time of the last test of the node.", func(n *nodeState) float64 {
+			return float64(n.testedAt.UnixNano()) / 1e9
+		}},
+	}
+
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, n := range nodes {
+			fmt.Fprintf(w, "%s{%s} %g\n", g.name, nodeLabels(n), g.value(n))
+		}
+	}
+
+	subGauges := []struct {
+		name  string
+		help  string
+		value func(sub *speedtester.SubscriptionInfo) float64
+	}{
+		{"clash_speedtest_subscription_used_bytes", "Traffic used of the subscription.", func(sub *speedtester.SubscriptionInfo) float64 { return float64(sub.Used()) }},
+		{"clash_speedtest_subscription_total_bytes", "Traffic quota of the subscription, 0 if unknown.", func(sub *speedtester.SubscriptionInfo) float64 { return float64(sub.Total) }},
+		{"clash_speedtest_subscription_expire_timestamp_seconds", "Unix time the subscription expires, 0 if never.", func(sub *speedtester.SubscriptionInfo) float64 {
+			if sub.Expire.IsZero() {
+				return 0
+			}
+			return float64(sub.Expire.Unix())
+		}},
+	}
+	for _, g := range subGauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, sub := range subs {
+			fmt.Fprintf(w, "%s{source=\"%s\",provider=\"%s\"} %g\n", g.name, escapeLabel(sub.Source), escapeLabel(sub.Provider), g.value(sub))
+		}
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"clash_speedtest_rounds_total", "Number of probing rounds started.", e.roundsTotal.Load()},
+		{"clash_speedtest_round_errors_total", "Number of probing rounds that failed to load proxies.", e.roundErrorsTotal.Load()},
+		{"clash_speedtest_tests_total", "Number of node tests run.", e.testsTotal.Load()},
+		{"clash_speedtest_transferred_bytes_total", "Bytes downloaded and uploaded through proxies.", e.bytesTotal.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	fmt.Fprintf(w, "# HELP clash_speedtest_last_round_duration_seconds Duration of the last probing round.\n")
+	fmt.Fprintf(w, "# TYPE clash_speedtest_last_round_duration_seconds gauge\n")
+	fmt.Fprintf(w, "clash_speedtest_last_round_duration_seconds %g\n", float64(e.lastRoundMillis.Load())/1000)
+}
+
+func nodeLabels(n *nodeState) string {
+	country := n.country
+	if country == "" {
+		country = "UNKNOWN"
+	}
+	return fmt.Sprintf(`name="%s",fingerprint="%s",type="%s",source="%s",country="%s"`,
+		escapeLabel(n.result.ProxyName),
+		escapeLabel(n.result.Fingerprint),
+		escapeLabel(n.result.ProxyType),
+		escapeLabel(speedtester.RedactSource(n.result.Source)),
+		escapeLabel(country))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
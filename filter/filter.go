@@ -0,0 +1,307 @@
+// Package filter 实现节点筛选表达式，例如：
+//
+//	type in (vless, hysteria2) && port != 443 && !name =~ "x[0-9]"
+//	latency < 300ms && download > 10MB/s && country in (JP, SG)
+//
+// 支持 && 、||、!、括号，比较运算符 == != < <= > >= 、正则匹配 =~ !~ 以及 in (...)、not in (...)。
+// 字段的类型由调用方提供，字面量在解析时按字段类型转换，字符串比较不区分大小写
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind 表示字段的类型
+type Kind int
+
+const (
+	String   Kind = iota
+	Number        // 数字，字面量可以带 % 后缀
+	Duration      // 时长，如 300ms、1.5s，不带单位时按毫秒
+	Speed         // 速度（字节每秒），如 10MB/s、512KB，不带单位时按字节每秒
+	Bool
+	Any // 类型未知，两边都是数字时按数字比较，否则按字符串比较
+)
+
+// Env 提供字段的值，String 和 Any 返回 string 或 float64，Number 和 Speed 返回 float64，
+// Duration 返回 time.Duration，Bool 返回 bool
+type Env interface {
+	Lookup(field string) (any, bool)
+}
+
+// Schema 返回字段的类型，未知字段返回 false
+type Schema func(field string) (Kind, bool)
+
+// Expr 是解析后的表达式
+type Expr struct {
+	root node
+	src  string
+}
+
+// Parse 按 schema 解析表达式
+func Parse(src string, schema Schema) (*Expr, error) {
+	p := &parser{schema: schema}
+	if err := p.tokenize(src); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.tokens[p.pos].text, p.tokens[p.pos].pos)
+	}
+	return &Expr{root: root, src: src}, nil
+}
+
+// Match 对 env 求值，表达式为 nil 时总是返回 true
+func (e *Expr) Match(env Env) bool {
+	if e == nil {
+		return true
+	}
+	return e.root.eval(env)
+}
+
+// Fields 返回表达式引用的全部字段
+func (e *Expr) Fields() []string {
+	if e == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var fields []string
+	e.root.walk(func(c *compare) {
+		if !seen[c.field] {
+			seen[c.field] = true
+			fields = append(fields, c.field)
+		}
+	})
+	return fields
+}
+
+// Split 将最外层 && 连接的条件拆成两部分：不引用 late 字段的条件放入 early，其余放入 late。
+// 用于在测试前先按节点属性过滤，测试后再按结果过滤。某一部分为空时返回 nil
+func (e *Expr) Split(isLate func(field string) bool) (early *Expr, late *Expr) {
+	if e == nil {
+		return nil, nil
+	}
+	var earlyNodes, lateNodes []node
+	for _, n := range conjuncts(e.root) {
+		usesLate := false
+		n.walk(func(c *compare) {
+			if isLate(c.field) {
+				usesLate = true
+			}
+		})
+		if usesLate {
+			lateNodes = append(lateNodes, n)
+		} else {
+			earlyNodes = append(earlyNodes, n)
+		}
+	}
+	return join(earlyNodes, e.src), join(lateNodes, e.src)
+}
+
+func (e *Expr) String() string {
+	if e == nil {
+		return ""
+	}
+	return e.src
+}
+
+func conjuncts(n node) []node {
+	if b, ok := n.(*binary); ok && b.op == "&&" {
+		return append(conjuncts(b.left), conjuncts(b.right)...)
+	}
+	return []node{n}
+}
+
+func join(nodes []node, src string) *Expr {
+	if len(nodes) == 0 {
+		return nil
+	}
+	root := nodes[0]
+	for _, n := range nodes[1:] {
+		root = &binary{op: "&&", left: root, right: n}
+	}
+	return &Expr{root: root, src: src}
+}
+
+type node interface {
+	eval(env Env) bool
+	walk(fn func(c *compare))
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (b *binary) eval(env Env) bool {
+	if b.op == "&&" {
+		return b.left.eval(env) && b.right.eval(env)
+	}
+	return b.left.eval(env) || b.right.eval(env)
+}
+
+func (b *binary) walk(fn func(c *compare)) {
+	b.left.walk(fn)
+	b.right.walk(fn)
+}
+
+type not struct {
+	x node
+}
+
+func (n *not) eval(env Env) bool        { return !n.x.eval(env) }
+func (n *not) walk(fn func(c *compare)) { n.x.walk(fn) }
+
+// compare 表示 字段 运算符 值 的比较，values 已按字段类型转换
+type compare struct {
+	field  string
+	kind   Kind
+	op     string
+	values []any
+	re     *regexp.Regexp
+}
+
+func (c *compare) walk(fn func(c *compare)) { fn(c) }
+
+func (c *compare) eval(env Env) bool {
+	v, ok := env.Lookup(c.field)
+	if !ok {
+		// 字段不存在时只有否定形式的比较成立
+		return c.op == "!=" || c.op == "!~" || c.op == "not in"
+	}
+
+	switch c.op {
+	case "=~":
+		return c.re.MatchString(fmt.Sprint(v))
+	case "!~":
+		return !c.re.MatchString(fmt.Sprint(v))
+	case "in":
+		for _, want := range c.values {
+			if compareValues(v, want) == 0 {
+				return true
+			}
+		}
+		return false
+	case "not in":
+		for _, want := range c.values {
+			if compareValues(v, want) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	cmp := compareValues(v, c.values[0])
+	switch c.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareValues 比较字段值和字面量，返回 -1、0、1
+func compareValues(v any, want any) int {
+	switch w := want.(type) {
+	case time.Duration:
+		d, _ := v.(time.Duration)
+		return compareOrdered(d, w)
+	case bool:
+		b, _ := v.(bool)
+		if b == w {
+			return 0
+		}
+		return 1
+	case float64:
+		switch n := v.(type) {
+		case float64:
+			return compareOrdered(n, w)
+		case string:
+			if f, err := strconv.ParseFloat(n, 64); err == nil {
+				return compareOrdered(f, w)
+			}
+		}
+		return compareOrdered(fmt.Sprint(v), strconv.FormatFloat(w, 'f', -1, 64))
+	case string:
+		return compareOrdered(strings.ToLower(fmt.Sprint(v)), strings.ToLower(w))
+	}
+	return 1
+}
+
+func compareOrdered[T string | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// convertLiteral 按字段类型转换字面量
+func convertLiteral(kind Kind, text string) (any, error) {
+	switch kind {
+	case Number:
+		return strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+	case Duration:
+		if ms, err := strconv.ParseFloat(text, 64); err == nil {
+			return time.Duration(ms * float64(time.Millisecond)), nil
+		}
+		return time.ParseDuration(text)
+	case Speed:
+		return parseSpeed(text)
+	case Bool:
+		return strconv.ParseBool(text)
+	case Any:
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+		return text, nil
+	default:
+		return text, nil
+	}
+}
+
+var speedUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"gb", 1024 * 1024 * 1024}, {"g", 1024 * 1024 * 1024},
+	{"mb", 1024 * 1024}, {"m", 1024 * 1024},
+	{"kb", 1024}, {"k", 1024},
+	{"b", 1},
+}
+
+// parseSpeed 解析 10MB/s、512KB、1.5G 形式的速度
+func parseSpeed(text string) (float64, error) {
+	s := strings.TrimSuffix(strings.ToLower(text), "/s")
+	scale := 1.0
+	for _, unit := range speedUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid speed %q", text)
+	}
+	return n * scale, nil
+}
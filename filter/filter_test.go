@@ -0,0 +1,179 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSchema = func(field string) (Kind, bool) {
+	switch field {
+	case "name", "type", "country":
+		return String, true
+	case "port", "packet_loss":
+		return Number, true
+	case "latency":
+		return Duration, true
+	case "download":
+		return Speed, true
+	case "udp":
+		return Bool, true
+	case "extra":
+		return Any, true
+	}
+	return 0, false
+}
+
+type mapEnv map[string]any
+
+func (e mapEnv) Lookup(field string) (any, bool) {
+	v, ok := e[field]
+	return v, ok
+}
+
+var testNode = mapEnv{
+	"name":        "HK 01 x3",
+	"type":        "Vless",
+	"country":     "HK",
+	"port":        float64(443),
+	"packet_loss": float64(5),
+	"latency":     120 * time.Millisecond,
+	"download":    float64(12 * 1024 * 1024),
+	"udp":         true,
+	"extra":       "ws",
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"latncy < 200ms", `unknown field "latncy"`},
+		{"latency <", "expected value"},
+		{"latency < fast", `invalid value "fast"`},
+		{"name < abc", "does not support <"},
+		{"(port == 1", "expected )"},
+		{"type in (vless", "expected , or )"},
+		{"type not vless", "expected in after not"},
+		{`name =~ "("`, "invalid regular expression"},
+		{`name == "abc`, "unterminated string"},
+		{"port == 1 port", `unexpected "port"`},
+		{"port # 1", "unexpected character"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.expr, testSchema)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error = %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"type == vless", true},
+		{"type != VLESS", false},
+		{"type in (trojan, vless)", true},
+		{"type not in (trojan, vless)", false},
+		{"port == 443 && latency < 200ms", true},
+		{"port != 443 || latency < 100", false},
+		{"latency <= 120", true},
+		{"latency > 0.1s", true},
+		{"download > 10MB/s", true},
+		{"download >= 13M", false},
+		{"packet_loss < 10%", true},
+		{`name =~ "x[0-9]"`, true},
+		{`!name =~ "x[0-9]"`, false},
+		{`name !~ "^JP"`, true},
+		{"udp == true", true},
+		{"extra == WS", true},
+		{"!(port == 443) || country in (JP, SG)", false},
+		{"(type == trojan || type == vless) && country == hk", true},
+	}
+	for _, tt := range tests {
+		if got := mustParse(t, tt.expr).Match(testNode); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestMatchMissingField(t *testing.T) {
+	env := mapEnv{"name": "a"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"country == JP", false},
+		{"country != JP", true},
+		{"country not in (JP)", true},
+		{"country =~ J", false},
+		{"country !~ J", true},
+	}
+	for _, tt := range tests {
+		if got := mustParse(t, tt.expr).Match(env); got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNilExpr(t *testing.T) {
+	var expr *Expr
+	if !expr.Match(testNode) {
+		t.Error("nil expression should match")
+	}
+	if expr.Fields() != nil || expr.String() != "" {
+		t.Error("nil expression should have no fields")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	expr := mustParse(t, "type == vless && latency < 200ms && (port == 443 || download > 1MB)")
+	isLate := func(field string) bool { return field == "latency" || field == "download" }
+	early, late := expr.Split(isLate)
+	if got := early.Fields(); len(got) != 1 || got[0] != "type" {
+		t.Errorf("early fields = %v", got)
+	}
+	if got := late.Fields(); len(got) != 3 {
+		t.Errorf("late fields = %v", got)
+	}
+	if !early.Match(testNode) || !late.Match(testNode) {
+		t.Error("both parts should match")
+	}
+
+	early, late = mustParse(t, "latency < 200ms").Split(isLate)
+	if early != nil || late == nil {
+		t.Errorf("Split = %v, %v, want only late part", early, late)
+	}
+}
+
+func mustParse(t *testing.T, src string) *Expr {
+	t.Helper()
+	expr, err := Parse(src, testSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expr
+}
+
+func TestParseSpeed(t *testing.T) {
+	tests := map[string]float64{
+		"512":     512,
+		"512KB":   512 * 1024,
+		"10MB/s":  10 * 1024 * 1024,
+		"1.5g":    1.5 * 1024 * 1024 * 1024,
+		"100b/s":  100,
+		"2k":      2048,
+		"0.5MB/s": 512 * 1024,
+	}
+	for text, want := range tests {
+		got, err := parseSpeed(text)
+		if err != nil || got != want {
+			t.Errorf("parseSpeed(%q) = %v, %v, want %v", text, got, err, want)
+		}
+	}
+	if _, err := parseSpeed("fast"); err == nil {
+		t.Error("parseSpeed(fast) should fail")
+	}
+}
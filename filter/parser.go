@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokWord   tokenKind = iota // 字段名、关键字或未加引号的值
+	tokString                  // 加引号的字符串
+	tokOp                      // 运算符和括号
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type parser struct {
+	schema Schema
+	tokens []token
+	pos    int
+}
+
+// 按长度从长到短排列，保证 <= 优先于 <
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", ","}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-./%:", r)
+}
+
+func (p *parser) tokenize(src string) error {
+	runes := []rune(src)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			var b strings.Builder
+			start := i
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			p.tokens = append(p.tokens, token{kind: tokString, text: b.String(), pos: start})
+		case isWordRune(r):
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				i++
+			}
+			p.tokens = append(p.tokens, token{kind: tokWord, text: string(runes[start:i]), pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					p.tokens = append(p.tokens, token{kind: tokOp, text: op, pos: i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) peek() *token {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *parser) acceptOp(op string) bool {
+	if t := p.peek(); t != nil && t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) acceptWord(word string) bool {
+	if t := p.peek(); t != nil && t.kind == tokWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	if t := p.peek(); t != nil {
+		return fmt.Errorf(format+" at position %d", append(args, t.pos)...)
+	}
+	return fmt.Errorf(format+" at end of expression", args...)
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.acceptOp("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{x: x}, nil
+	}
+	if p.acceptOp("(") {
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptOp(")") {
+			return nil, p.errorf("expected )")
+		}
+		return x, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokWord {
+		return nil, p.errorf("expected field name")
+	}
+	field := strings.ToLower(t.text)
+	kind, ok := p.schema(field)
+	if !ok {
+		return nil, p.errorf("unknown field %q", t.text)
+	}
+	p.pos++
+
+	c := &compare{field: field, kind: kind}
+	switch {
+	case p.acceptWord("in"):
+		c.op = "in"
+	case p.acceptWord("not"):
+		if !p.acceptWord("in") {
+			return nil, p.errorf("expected in after not")
+		}
+		c.op = "not in"
+	default:
+		op := p.peek()
+		if op == nil || op.kind != tokOp {
+			return nil, p.errorf("expected operator after %s", field)
+		}
+		switch op.text {
+		case "==", "!=", "<", "<=", ">", ">=", "=~", "!~":
+			c.op = op.text
+			p.pos++
+		default:
+			return nil, p.errorf("expected operator after %s", field)
+		}
+	}
+
+	if c.op == "in" || c.op == "not in" {
+		if !p.acceptOp("(") {
+			return nil, p.errorf("expected ( after %s", c.op)
+		}
+		for {
+			v, err := p.parseLiteral(kind)
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, v)
+			if p.acceptOp(")") {
+				break
+			}
+			if !p.acceptOp(",") {
+				return nil, p.errorf("expected , or )")
+			}
+		}
+		return c, nil
+	}
+
+	if c.op == "=~" || c.op == "!~" {
+		t := p.peek()
+		if t == nil || t.kind == tokOp {
+			return nil, p.errorf("expected regular expression")
+		}
+		re, err := regexp.Compile(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", t.text, err)
+		}
+		p.pos++
+		c.re = re
+		return c, nil
+	}
+
+	switch c.op {
+	case "<", "<=", ">", ">=":
+		if kind == String || kind == Bool {
+			return nil, fmt.Errorf("field %s does not support %s", field, c.op)
+		}
+	}
+	v, err := p.parseLiteral(kind)
+	if err != nil {
+		return nil, err
+	}
+	c.values = []any{v}
+	return c, nil
+}
+
+func (p *parser) parseLiteral(kind Kind) (any, error) {
+	t := p.peek()
+	if t == nil || t.kind == tokOp {
+		return nil, p.errorf("expected value")
+	}
+	v, err := convertLiteral(kind, t.text)
+	if err != nil {
+		return nil, p.errorf("invalid value %q", t.text)
+	}
+	p.pos++
+	return v, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/faceair/clash-speedtest/history"
+	"github.com/faceair/clash-speedtest/speedtester"
+	"github.com/olekukonko/tablewriter"
+)
+
+// queryHistory 根据 -history-node / -history-compare 输出历史记录
+func queryHistory(store *history.Store) error {
+	if *historyNode != "" {
+		nodes, err := store.FindNodes(*historyNode)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("no node matches %q", *historyNode)
+		}
+		for _, node := range nodes {
+			if err := printNodeHistory(store, node.NodeID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *historyCompare {
+		comparison, err := store.CompareLatest(history.RunSource(*configPathsConfig))
+		if err != nil {
+			return err
+		}
+		printComparison(comparison)
+	}
+	return nil
+}
+
+func printNodeHistory(store *history.Store, nodeID string) error {
+	stats, err := store.Stats(nodeID, *historyWindow)
+	if err != nil {
+		return err
+	}
+	records, err := store.History(nodeID, *historyWindow)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%s (%s)\n", stats.Name, stats.NodeID)
+	fmt.Printf("最近 %d 次: 可用率 %.1f%%, 平均延迟 %dms, 平均抖动 %dms, 平均下载 %s, 平均上传 %s\n",
+		stats.Samples,
+		stats.Uptime,
+		stats.AvgLatency.Milliseconds(),
+		stats.AvgJitter.Milliseconds(),
+		speedtester.FormatSpeed(stats.AvgDownloadSpeed),
+		speedtester.FormatSpeed(stats.AvgUploadSpeed))
+
+	table := newPlainTable([]string{"时间", "节点名称", "状态", "延迟", "下载速度", "上传速度"})
+	for _, r := range records {
+		status := colorGreen + "UP" + colorReset
+		if !r.Alive {
+			status = colorRed + "DOWN" + colorReset
+		}
+		table.Append([]string{
+			r.TestedAt.Local().Format(time.DateTime),
+			r.Name,
+			status,
+			fmt.Sprintf("%dms", r.Latency.Milliseconds()),
+			speedtester.FormatSpeed(r.DownloadSpeed),
+			speedtester.FormatSpeed(r.UploadSpeed),
+		})
+	}
+	table.Render()
+	return nil
+}
+
+func printComparison(comparison *history.Comparison) {
+	fmt.Printf("\n来源 %s: 对比 %s (%d/%d 可用) 与 %s (%d/%d 可用)\n",
+		comparison.Current.Source,
+		comparison.Current.StartedAt.Local().Format(time.DateTime),
+		comparison.Current.AliveCount, comparison.Current.NodeCount,
+		comparison.Previous.StartedAt.Local().Format(time.DateTime),
+		comparison.Previous.AliveCount, comparison.Previous.NodeCount)
+
+	table := newPlainTable([]string{"节点名称", "变化", "延迟变化", "下载速度变化"})
+	for _, diff := range comparison.Nodes {
+		var status string
+		switch diff.Status {
+		case "up", "new":
+			status = colorGreen + diff.Status + colorReset
+		case "down", "gone":
+			status = colorRed + diff.Status + colorReset
+		default:
+			status = diff.Status
+		}
+		table.Append([]string{
+			diff.Name,
+			status,
+			fmt.Sprintf("%+dms", diff.LatencyDelta().Milliseconds()),
+			fmt.Sprintf("%+.2fMB/s", diff.DownloadDelta()/(1024*1024)),
+		})
+	}
+	table.Render()
+}
+
+func newPlainTable(headers []string) *tablewriter.Table {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(headers)
+	table.SetAutoWrapText(false)
+	table.SetAutoFormatHeaders(true)
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetCenterSeparator("")
+	table.SetColumnSeparator("")
+	table.SetRowSeparator("")
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetTablePadding("\t")
+	table.SetNoWhiteSpace(true)
+	return table
+}
@@ -0,0 +1,310 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+	bbolt "github.com/metacubex/bbolt"
+)
+
+var (
+	recordsBucket = []byte("records") // 每个节点一个子 bucket，key 为运行 ID
+	runsBucket    = []byte("runs")    // key 为运行 ID，value 为 RunInfo
+)
+
+// Record 表示某个节点在一次运行中的测试结果
+type Record struct {
+	NodeID        string        `json:"node_id"`
+	RunID         int64         `json:"run_id"`
+	Name          string        `json:"name"`
+	Type          string        `json:"type"`
+	Source        string        `json:"source"`
+	TestedAt      time.Time     `json:"tested_at"`
+	Alive         bool          `json:"alive"`
+	Latency       time.Duration `json:"latency"`
+	Jitter        time.Duration `json:"jitter"`
+	PacketLoss    float64       `json:"packet_loss"`
+	DownloadSpeed float64       `json:"download_speed"`
+	UploadSpeed   float64       `json:"upload_speed"`
+}
+
+// RunInfo 表示一次运行的概要
+type RunInfo struct {
+	ID         int64     `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	Source     string    `json:"source,omitempty"` // 测速的配置来源，见 RunSource
+	NodeCount  int       `json:"node_count"`
+	AliveCount int       `json:"alive_count"`
+}
+
+// Store 基于 bbolt 的本地测速历史存储
+type Store struct {
+	db        *bbolt.DB
+	retention int
+}
+
+// Open 打开（或创建）位于 path 的历史数据库，只保留最近 retention 次运行，retention <= 0 表示全部保留
+func Open(path string, retention int) (*Store, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open history db %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{recordsBucket, runsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, retention: retention}, nil
+}
+
+// Close 关闭数据库
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// RunSource 返回 configPaths（逗号分隔的配置路径或订阅地址）对应的运行来源，订阅地址去掉凭据和查询参数
+func RunSource(configPaths string) string {
+	var sources []string
+	for _, path := range strings.Split(configPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			sources = append(sources, speedtester.RedactSource(path))
+		}
+	}
+	return strings.Join(sources, ",")
+}
+
+// SaveRun 将一次运行的所有结果写入数据库，返回运行 ID。
+// source 标识测速的配置，CompareLatest 只对比相同来源的运行。超过保留次数时删除最早的运行
+func (s *Store) SaveRun(startedAt time.Time, source string, results []*speedtester.Result) (int64, error) {
+	runID := startedAt.UnixNano()
+	runKey := encodeKey(runID)
+	run := &RunInfo{
+		ID:        runID,
+		StartedAt: startedAt,
+		Source:    source,
+	}
+
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		for _, result := range results {
+			if result == nil {
+				continue
+			}
+			record := newRecord(runID, startedAt, result)
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			node, err := records.CreateBucketIfNotExists([]byte(record.NodeID))
+			if err != nil {
+				return err
+			}
+			if err := node.Put(runKey, data); err != nil {
+				return err
+			}
+			run.NodeCount++
+			if record.Alive {
+				run.AliveCount++
+			}
+		}
+
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(runsBucket).Put(runKey, data); err != nil {
+			return err
+		}
+		return s.prune(tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return runID, nil
+}
+
+// prune 删除超过保留次数的最早运行及其记录，并删除已没有记录的节点
+func (s *Store) prune(tx *bbolt.Tx) error {
+	if s.retention <= 0 {
+		return nil
+	}
+	// 从最新的运行向前数，保留次数之外的都过期
+	runs := tx.Bucket(runsBucket)
+	var expired [][]byte
+	kept := 0
+	c := runs.Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if kept < s.retention {
+			kept++
+			continue
+		}
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	for _, k := range expired {
+		if err := runs.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	records := tx.Bucket(recordsBucket)
+	var empty [][]byte
+	err := records.ForEachBucket(func(name []byte) error {
+		node := records.Bucket(name)
+		for _, k := range expired {
+			if err := node.Delete(k); err != nil {
+				return err
+			}
+		}
+		if k, _ := node.Cursor().First(); k == nil {
+			empty = append(empty, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range empty {
+		if err := records.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRecord(runID int64, startedAt time.Time, result *speedtester.Result) *Record {
+	return &Record{
+		NodeID:        nodeID(result),
+		RunID:         runID,
+		Name:          result.ProxyName,
+		Type:          result.ProxyType,
+		Source:        result.Source,
+		TestedAt:      startedAt,
+		Alive:         result.Latency > 0,
+		Latency:       result.Latency,
+		Jitter:        result.Jitter,
+		PacketLoss:    result.PacketLoss,
+		DownloadSpeed: result.DownloadSpeed,
+		UploadSpeed:   result.UploadSpeed,
+	}
+}
+
+// nodeID 返回结果对应的节点标识，即节点指纹
+func nodeID(result *speedtester.Result) string {
+	if result.Fingerprint != "" {
+		return result.Fingerprint
+	}
+	return speedtester.Fingerprint(result.ProxyConfig)
+}
+
+// History 返回节点最近的 limit 条记录，按时间倒序；limit <= 0 表示全部
+func (s *Store) History(nodeID string, limit int) ([]*Record, error) {
+	var records []*Record
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		node := tx.Bucket(recordsBucket).Bucket([]byte(nodeID))
+		if node == nil {
+			return nil
+		}
+		c := node.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			record := &Record{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			if limit > 0 && len(records) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// FindNodes 按节点 ID 或名称子串查找节点，返回每个节点最近一次的记录
+func (s *Store) FindNodes(query string) ([]*Record, error) {
+	var matched []*Record
+	lowerQuery := strings.ToLower(query)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEachBucket(func(k []byte) error {
+			_, v := tx.Bucket(recordsBucket).Bucket(k).Cursor().Last()
+			if v == nil {
+				return nil
+			}
+			record := &Record{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			if string(k) == query || strings.Contains(strings.ToLower(record.Name), lowerQuery) {
+				matched = append(matched, record)
+			}
+			return nil
+		})
+	})
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Name < matched[j].Name
+	})
+	return matched, err
+}
+
+// Runs 返回最近的 limit 次运行，按时间倒序
+func (s *Store) Runs(limit int) ([]*RunInfo, error) {
+	var runs []*RunInfo
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(runsBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			run := &RunInfo{}
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+			if limit > 0 && len(runs) >= limit {
+				break
+			}
+		}
+		return nil
+	})
+	return runs, err
+}
+
+// runRecords 返回某次运行中所有节点的记录
+func (s *Store) runRecords(runID int64) (map[string]*Record, error) {
+	records := make(map[string]*Record)
+	runKey := encodeKey(runID)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket)
+		return bucket.ForEachBucket(func(k []byte) error {
+			v := bucket.Bucket(k).Get(runKey)
+			if v == nil {
+				return nil
+			}
+			record := &Record{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			records[record.NodeID] = record
+			return nil
+		})
+	})
+	return records, err
+}
+
+func encodeKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
@@ -0,0 +1,181 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// NodeStats 表示节点在若干次运行中的统计结果
+type NodeStats struct {
+	NodeID           string        `json:"node_id"`
+	Name             string        `json:"name"`
+	Samples          int           `json:"samples"`
+	Uptime           float64       `json:"uptime"` // 可用次数占比（百分比）
+	AvgLatency       time.Duration `json:"avg_latency"`
+	AvgJitter        time.Duration `json:"avg_jitter"`
+	AvgPacketLoss    float64       `json:"avg_packet_loss"`
+	AvgDownloadSpeed float64       `json:"avg_download_speed"`
+	AvgUploadSpeed   float64       `json:"avg_upload_speed"`
+	FirstSeen        time.Time     `json:"first_seen"`
+	LastSeen         time.Time     `json:"last_seen"`
+}
+
+// Stats 计算节点最近 window 次运行的可用率与滚动平均值，window <= 0 表示全部记录
+func (s *Store) Stats(nodeID string, window int) (*NodeStats, error) {
+	records, err := s.History(nodeID, window)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no history for node %s", nodeID)
+	}
+	return computeStats(records), nil
+}
+
+// computeStats 计算记录的统计值，平均值只统计可用的记录
+func computeStats(records []*Record) *NodeStats {
+	stats := &NodeStats{
+		NodeID:    records[0].NodeID,
+		Name:      records[0].Name,
+		Samples:   len(records),
+		LastSeen:  records[0].TestedAt,
+		FirstSeen: records[len(records)-1].TestedAt,
+	}
+
+	var alive int
+	var latency, jitter time.Duration
+	for _, r := range records {
+		if !r.Alive {
+			continue
+		}
+		alive++
+		latency += r.Latency
+		jitter += r.Jitter
+		stats.AvgPacketLoss += r.PacketLoss
+		stats.AvgDownloadSpeed += r.DownloadSpeed
+		stats.AvgUploadSpeed += r.UploadSpeed
+	}
+
+	stats.Uptime = float64(alive) / float64(len(records)) * 100
+	if alive > 0 {
+		stats.AvgLatency = latency / time.Duration(alive)
+		stats.AvgJitter = jitter / time.Duration(alive)
+		stats.AvgPacketLoss /= float64(alive)
+		stats.AvgDownloadSpeed /= float64(alive)
+		stats.AvgUploadSpeed /= float64(alive)
+	}
+	return stats
+}
+
+// NodeDiff 表示节点在最近两次运行之间的变化
+type NodeDiff struct {
+	NodeID   string  `json:"node_id"`
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // new, gone, up, down, same
+	Current  *Record `json:"current,omitempty"`
+	Previous *Record `json:"previous,omitempty"`
+}
+
+// LatencyDelta 返回延迟变化，任一方不可用时返回 0
+func (d *NodeDiff) LatencyDelta() time.Duration {
+	if d.Current == nil || d.Previous == nil || !d.Current.Alive || !d.Previous.Alive {
+		return 0
+	}
+	return d.Current.Latency - d.Previous.Latency
+}
+
+// DownloadDelta 返回下载速度变化，任一方不可用时返回 0
+func (d *NodeDiff) DownloadDelta() float64 {
+	if d.Current == nil || d.Previous == nil || !d.Current.Alive || !d.Previous.Alive {
+		return 0
+	}
+	return d.Current.DownloadSpeed - d.Previous.DownloadSpeed
+}
+
+// Comparison 表示最近一次运行与上一次运行的对比
+type Comparison struct {
+	Current  *RunInfo    `json:"current"`
+	Previous *RunInfo    `json:"previous"`
+	Nodes    []*NodeDiff `json:"nodes"`
+}
+
+// CompareLatest 对比 source 最近两次运行，source 为空时使用最近一次运行的来源
+func (s *Store) CompareLatest(source string) (*Comparison, error) {
+	allRuns, err := s.Runs(0)
+	if err != nil {
+		return nil, err
+	}
+	if source == "" && len(allRuns) > 0 {
+		source = allRuns[0].Source
+	}
+	var runs []*RunInfo
+	for _, run := range allRuns {
+		if run.Source == source {
+			runs = append(runs, run)
+		}
+		if len(runs) == 2 {
+			break
+		}
+	}
+	if len(runs) < 2 {
+		return nil, fmt.Errorf("need at least 2 runs of %q to compare, got %d", source, len(runs))
+	}
+
+	current, err := s.runRecords(runs[0].ID)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := s.runRecords(runs[1].ID)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &Comparison{
+		Current:  runs[0],
+		Previous: runs[1],
+	}
+	for id, cur := range current {
+		diff := &NodeDiff{NodeID: id, Name: cur.Name, Current: cur}
+		prev, ok := previous[id]
+		switch {
+		case !ok:
+			diff.Status = "new"
+		case cur.Alive && !prev.Alive:
+			diff.Status = "up"
+		case !cur.Alive && prev.Alive:
+			diff.Status = "down"
+		default:
+			diff.Status = "same"
+		}
+		if ok {
+			diff.Previous = prev
+		}
+		comparison.Nodes = append(comparison.Nodes, diff)
+	}
+	for id, prev := range previous {
+		if _, ok := current[id]; !ok {
+			comparison.Nodes = append(comparison.Nodes, &NodeDiff{
+				NodeID:   id,
+				Name:     prev.Name,
+				Status:   "gone",
+				Previous: prev,
+			})
+		}
+	}
+	sort.Slice(comparison.Nodes, func(i, j int) bool {
+		return comparison.Nodes[i].Name < comparison.Nodes[j].Name
+	})
+	return comparison, nil
+}
+
+// Stability 返回按节点最近 window 次运行的可用率（0-1）计算稳定性的函数，供综合评分使用
+func (s *Store) Stability(window int) func(nodeID string) (float64, bool) {
+	return func(nodeID string) (float64, bool) {
+		stats, err := s.Stats(nodeID, window)
+		if err != nil {
+			return 0, false
+		}
+		return stats.Uptime / 100, true
+	}
+}
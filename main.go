@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"sort"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/faceair/clash-speedtest/exporter"
+	"github.com/faceair/clash-speedtest/history"
+	"github.com/faceair/clash-speedtest/speedserver"
 	"github.com/faceair/clash-speedtest/speedtester"
 	"github.com/faceair/clash-speedtest/webserver"
 	"github.com/google/uuid"
@@ -23,6 +32,7 @@ var (
 	filterRegexConfig = flag.String("f", ".+", "filter proxies by name, use regexp")
 	blockKeywords     = flag.String("b", "", "block proxies by keywords, use | to separate multiple keywords (example: -b 'rate|x1|1x')")
 	serverURL         = flag.String("server-url", "https://speed.cloudflare.com", "server url")
+	serverToken       = flag.String("server-token", os.Getenv("DOWNLOAD_SERVER_TOKEN"), "bearer token of the speed test server, see download-server -token (default $DOWNLOAD_SERVER_TOKEN)")
 	downloadSize      = flag.Int("download-size", 50*1024*1024, "download size for testing proxies")
 	uploadSize        = flag.Int("upload-size", 20*1024*1024, "upload size for testing proxies")
 	timeout           = flag.Duration("timeout", time.Second*5, "timeout for testing proxies")
@@ -34,10 +44,83 @@ var (
 	minUploadSpeed    = flag.Float64("min-upload-speed", 2, "filter upload speed less than this value(unit: MB/s)")
 	renameNodes       = flag.Bool("rename", false, "rename nodes with IP location and speed")
 	fastMode          = flag.Bool("fast", false, "fast mode, only test latency")
+	groupsConfig      = flag.String("groups", "", "only test proxies in these proxy groups, use , to separate multiple groups")
+	dedupMode         = flag.String("dedup", speedtester.DedupExact, "collapse duplicate proxies: none, exact (same config), endpoint (same server and port), exit-ip (same exit ip)")
 	webMode           = flag.Bool("web", false, "enable web server mode")
 	webPort           = flag.Int("port", 8080, "web server port (only used in web mode)")
+	webListen         = flag.String("listen", "", "web server listen address, overrides -port (example: 127.0.0.1:8443)")
+	webTLSCert        = flag.String("tls-cert", "", "web server TLS certificate file")
+	webTLSKey         = flag.String("tls-key", "", "web server TLS private key file")
+	webTLSReload      = flag.Duration("tls-reload", 0, "interval to check and reload TLS certificate, 0 to disable")
+	webMaxBodySize    = flag.Int64("max-body-size", 10*1024*1024, "max request body size in bytes (only used in web mode)")
+	webMaxNodes       = flag.Int("max-nodes", 1000, "max proxies per speedtest request, 0 for unlimited (only used in web mode)")
+	webShutdownWait   = flag.Duration("shutdown-timeout", 5*time.Minute, "max time to wait for running jobs on shutdown (only used in web mode)")
+	webSpeedServer    = flag.Bool("speedtest-server", false, "also serve the download-server endpoints (/__down, /__up, /ping, /ws) in web mode")
+	webSpeedPublic    = flag.Bool("speedtest-server-public", false, "do not require AUTH_KEY for the download-server endpoints in web mode")
+	daemonMode        = flag.Bool("daemon", false, "re-test proxies periodically and expose prometheus metrics on /metrics")
+	daemonInterval    = flag.Duration("interval", 5*time.Minute, "interval between test rounds (only used in daemon mode)")
+	metricsListen     = flag.String("metrics-listen", ":9090", "metrics listen address (only used in daemon mode without -web)")
+	resolveCountry    = flag.Bool("resolve-country", true, "resolve exit country of alive nodes for metrics labels (only used in daemon mode)")
+	historyPath       = flag.String("history", "", "history database file path, record every run when set")
+	historyNode       = flag.String("history-node", "", "show history of nodes matching this id or name (requires -history)")
+	historyWindow     = flag.Int("history-window", 10, "number of recent runs used for uptime and rolling averages")
+	historyCompare    = flag.Bool("history-compare", false, "compare the latest run with the previous one of the same config (-c, defaults to the config of the latest run; requires -history)")
+	historyRetention  = flag.Int("history-retention", 200, "number of most recent runs kept in the history database, 0 keeps all")
+	userAgent         = flag.String("user-agent", "clash.meta", "User-Agent for fetching subscriptions")
+	fetchTimeout      = flag.Duration("fetch-timeout", 30*time.Second, "timeout for fetching subscriptions")
+	fetchRetries      = flag.Int("fetch-retries", 2, "retries with backoff when fetching subscriptions fails")
+	cacheDir          = flag.String("cache-dir", "", "cache subscriptions in this directory, revalidate with ETag/Last-Modified and fall back to cache on failure")
+	fetchProxy        = flag.String("fetch-proxy", "", "fetch subscriptions through this proxy (example: socks5://127.0.0.1:1080)")
+	fetchHeaders      = make(headerFlag)
+	filterExpr        = flag.String("filter-expr", "", "filter expression over node attributes and results (example: 'type in (vless, trojan) && latency < 300ms')")
+	countries         = flag.String("countries", "", "only keep proxies whose exit IP is in these countries, use , to separate multiple country codes (example: JP,SG)")
+	excludeCountries  = flag.String("exclude-countries", "", "drop proxies whose exit IP is in these countries, use , to separate multiple country codes")
+	topPerCountry     = flag.Int("top-per-country", 0, "only keep the best N proxies of each exit country in the output, 0 for unlimited")
+	topBy             = flag.String("top-by", "", "sort key for -top-per-country: latency, jitter, packet_loss, download, upload (default download, latency in fast mode)")
+	sortKey           = flag.String("sort", "", "sort results by: latency, jitter, packet_loss, download, upload, score, name (default download, latency in fast mode)")
+	scoreWeights      = flag.String("score-weights", "", "weights of the composite score (example: latency=0.4,download=0.4,stability=0.2)")
+	stageTopK         = flag.Int("stage-top-k", 0, "staged test: latency for all, short probe for survivors, full speed test only for the best K by probe score, 0 to test every node fully")
+	probeSize         = flag.Int("probe-size", 1024*1024, "download size of the short probe in staged test")
+	probeMinSpeed     = flag.Float64("probe-min-speed", 0, "drop proxies whose probe speed is less than this value in staged test(unit: MB/s)")
+	trafficBudget     = flag.String("traffic-budget", "", "stop bandwidth tests once this much traffic has gone through proxies (example: 2GB), empty for unlimited")
+	payloadMode       = flag.String("payload", speedtester.PayloadZero, "download payload served by the speed test server: zero, random (requires download-server -payload random)")
+	verifyPayload     = flag.Bool("verify-payload", false, "verify downloaded bytes match the -payload pattern, proxies with mismatched downloads are marked as failed")
+	pingCount         = flag.Int("ping-count", 0, "measure jitter and packet loss with this many pings over the WebSocket echo of download-server, 0 to disable")
+	baseline          = flag.Bool("baseline", false, "test the speed test server without proxy first as a baseline of the local network")
+	baselinePercent   = flag.Bool("baseline-percent", false, "show latency and speeds as a percentage of the direct baseline (requires -baseline)")
+	streamServer      = flag.String("stream-server", "", "raw TCP stream address of download-server (example: your-server:8083), test raw TCP throughput when set")
+	streamDuration    = flag.Duration("stream-duration", 5*time.Second, "duration of each direction of the raw TCP stream test")
+	udpEcho           = flag.String("udp-echo", "", "UDP echo address of download-server (example: your-server:8081), test UDP latency and packet loss when set")
+	acceptStatus      = flag.String("accept-status", "200,204", "status codes accepted by the latency test, use , to separate multiple codes")
+	dryRun            = flag.Bool("dry-run", false, "only parse and lint the configs without testing, exit non-zero on errors (same as the lint subcommand)")
 )
 
+func init() {
+	flag.Var(fetchHeaders, "fetch-header", "extra header for fetching subscriptions, can be repeated (example: -fetch-header 'Authorization: Bearer xxx')")
+}
+
+// headerFlag 是可重复指定的 "Key: Value" 请求头参数
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var headers []string
+	for k, values := range h {
+		for _, v := range values {
+			headers = append(headers, k+": "+v)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(k) == "" {
+		return fmt.Errorf("invalid header %q, expected 'Key: Value'", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	return nil
+}
+
 const (
 	colorRed    = "\033[31m"
 	colorGreen  = "\033[32m"
@@ -46,47 +129,170 @@ const (
 )
 
 func main() {
-	flag.Parse()
+	// clash-speedtest lint -c config.yaml 等同于 -dry-run
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		flag.CommandLine.Parse(os.Args[2:])
+		*dryRun = true
+	} else {
+		flag.Parse()
+	}
 	log.SetLevel(log.SILENT)
 
+	switch *dedupMode {
+	case speedtester.DedupNone, speedtester.DedupExact, speedtester.DedupEndpoint, speedtester.DedupExitIP:
+	default:
+		log.Fatalln("invalid -dedup value: %s", *dedupMode)
+	}
+	if _, _, err := speedtester.ParseFilter(*filterExpr); err != nil {
+		log.Fatalln("invalid -filter-expr: %v", err)
+	}
+	if err := speedtester.ValidateSortKey(*topBy); err != nil {
+		log.Fatalln("invalid -top-by: %v", err)
+	}
+	if err := speedtester.ValidateSortKey(*sortKey); err != nil {
+		log.Fatalln("invalid -sort: %v", err)
+	}
+	weights, err := speedtester.ParseScoreWeights(*scoreWeights)
+	if err != nil {
+		log.Fatalln("invalid -score-weights: %v", err)
+	}
+	if *payloadMode != speedtester.PayloadZero && *payloadMode != speedtester.PayloadRandom {
+		log.Fatalln("invalid -payload value: %s", *payloadMode)
+	}
+	statusCodes, err := parseStatusCodes(*acceptStatus)
+	if err != nil {
+		log.Fatalln("invalid -accept-status: %v", err)
+	}
+	var budget int64
+	if *trafficBudget != "" {
+		if budget, err = speedtester.ParseBytes(*trafficBudget); err != nil {
+			log.Fatalln("invalid -traffic-budget: %v", err)
+		}
+	}
+
+	// 静态检查
+	if *dryRun {
+		if *configPathsConfig == "" {
+			log.Fatalln("please specify the configuration file")
+		}
+		issues := speedtester.New(newSpeedTesterConfig(&weights, budget, statusCodes, nil)).Lint(*stashCompatible)
+		if printLintIssues(issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// 测速历史
+	var historyStore *history.Store
+	if *historyPath != "" {
+		var err error
+		historyStore, err = history.Open(*historyPath, *historyRetention)
+		if err != nil {
+			log.Fatalln("open history failed: %v", err)
+		}
+		defer historyStore.Close()
+	} else if *historyNode != "" || *historyCompare {
+		log.Fatalln("please specify the history database with -history")
+	}
+	if *baselinePercent && !*baseline {
+		log.Fatalln("-baseline-percent requires -baseline")
+	}
+
+	// 历史查询
+	if *historyNode != "" || *historyCompare {
+		if err := queryHistory(historyStore); err != nil {
+			log.Fatalln("query history failed: %v", err)
+		}
+		return
+	}
+
+	// 周期测速导出器
+	var metricsExporter *exporter.Exporter
+	if *daemonMode {
+		if *configPathsConfig == "" {
+			log.Fatalln("please specify the configuration file")
+		}
+		metricsExporter = exporter.New(speedtester.New(newSpeedTesterConfig(&weights, budget, statusCodes, historyStore)), &exporter.Config{
+			Interval:        *daemonInterval,
+			StashCompatible: *stashCompatible,
+			ResolveCountry:  *resolveCountry,
+			History:         historyStore,
+			Source:          history.RunSource(*configPathsConfig),
+		})
+	}
+
 	// Web 模式
 	if *webMode {
-		server, err := webserver.New(*webPort)
+		addr := *webListen
+		if addr == "" {
+			addr = fmt.Sprintf(":%d", *webPort)
+		}
+		var speedServerConfig *speedserver.Config
+		if *webSpeedServer {
+			speedServerConfig = &speedserver.Config{
+				Payload:   speedtester.PayloadZero,
+				MaxBytes:  1024 * 1024 * 1024,
+				AccessLog: true,
+			}
+		}
+		server, err := webserver.New(&webserver.Config{
+			Addr:              addr,
+			TLSCertFile:       *webTLSCert,
+			TLSKeyFile:        *webTLSKey,
+			TLSReload:         *webTLSReload,
+			ShutdownTimeout:   *webShutdownWait,
+			MaxBodySize:       *webMaxBodySize,
+			MaxNodes:          *webMaxNodes,
+			History:           historyStore,
+			HistoryWindow:     *historyWindow,
+			SpeedServer:       speedServerConfig,
+			SpeedServerPublic: *webSpeedPublic,
+		})
 		if err != nil {
 			log.Fatalln("初始化 Web 服务器失败: %v", err)
 		}
 
+		if metricsExporter != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server.Handle("/metrics", metricsExporter)
+			go metricsExporter.Run(ctx)
+		}
+
 		if err := server.Start(); err != nil {
 			log.Fatalln("启动 Web 服务器失败: %v", err)
 		}
 		return
 	}
 
+	// 独立的周期测速模式
+	if metricsExporter != nil {
+		if err := runDaemon(metricsExporter); err != nil {
+			log.Fatalln("metrics server failed: %v", err)
+		}
+		return
+	}
+
 	// CLI 模式
 	if *configPathsConfig == "" {
 		log.Fatalln("please specify the configuration file")
 	}
 
-	speedTester := speedtester.New(&speedtester.Config{
-		ConfigPaths:      *configPathsConfig,
-		FilterRegex:      *filterRegexConfig,
-		BlockRegex:       *blockKeywords,
-		ServerURL:        *serverURL,
-		DownloadSize:     *downloadSize,
-		UploadSize:       *uploadSize,
-		Timeout:          *timeout,
-		Concurrent:       *concurrent,
-		MaxLatency:       *maxLatency,
-		MinDownloadSpeed: *minDownloadSpeed * 1024 * 1024,
-		MinUploadSpeed:   *minUploadSpeed * 1024 * 1024,
-		FastMode:         *fastMode,
-	})
+	speedTester := speedtester.New(newSpeedTesterConfig(&weights, budget, statusCodes, historyStore))
 
 	allProxies, err := speedTester.LoadProxies(*stashCompatible)
 	if err != nil {
 		log.Fatalln("load proxies failed: %v", err)
 	}
 
+	printTrafficEstimate(speedTester.EstimateTraffic(len(allProxies)), budget)
+	var baselineResult *speedtester.Result
+	if *baseline {
+		baselineResult = speedTester.TestBaseline()
+		printBaseline(speedTester, baselineResult)
+	}
+
+	startedAt := time.Now()
 	bar := progressbar.Default(int64(len(allProxies)), "测试中...")
 	results := make([]*speedtester.Result, 0)
 	speedTester.TestProxies(allProxies, func(result *speedtester.Result) {
@@ -95,11 +301,37 @@ func main() {
 		results = append(results, result)
 	})
 
-	sort.Slice(results, func(i, j int) bool {
-		return results[i].DownloadSpeed > results[j].DownloadSpeed
-	})
+	speedTester.SortResults(results)
 
 	printResults(results)
+	if baselineResult != nil {
+		printBaseline(speedTester, baselineResult)
+	}
+	printHopLatencies(results)
+	if *streamServer != "" && !*fastMode {
+		printStreamIntervals(results)
+	}
+	if groups := speedTester.ReportGroups(results); len(groups) > 0 {
+		printGroupReports(groups)
+	}
+	printSourceSummaries(speedTester.SummarizeSources(results))
+	if *stageTopK > 0 && !*fastMode {
+		printStageSummary(results)
+	}
+	if subs := speedTester.Subscriptions(); len(subs) > 0 {
+		printSubscriptions(subs)
+	}
+	if n := speedTester.DuplicateCount(); n > 0 {
+		fmt.Printf("collapsed %d duplicate proxies (dedup: %s)\n", n, *dedupMode)
+	}
+	printTrafficUsage(speedTester, results, budget)
+	printFailReasons(results)
+
+	if historyStore != nil {
+		if _, err := historyStore.SaveRun(startedAt, history.RunSource(*configPathsConfig), results); err != nil {
+			log.Fatalln("save history failed: %v", err)
+		}
+	}
 
 	if *outputPath != "" {
 		err = saveConfig(results, speedTester)
@@ -110,6 +342,88 @@ func main() {
 	}
 }
 
+// newSpeedTesterConfig 根据命令行参数创建测速配置，指定了测速历史时用节点的历史可用率参与评分
+func newSpeedTesterConfig(weights *speedtester.ScoreWeights, budget int64, statusCodes []int, historyStore *history.Store) *speedtester.Config {
+	config := &speedtester.Config{
+		ConfigPaths:      *configPathsConfig,
+		FilterRegex:      *filterRegexConfig,
+		BlockRegex:       *blockKeywords,
+		ServerURL:        *serverURL,
+		DownloadSize:     *downloadSize,
+		UploadSize:       *uploadSize,
+		Timeout:          *timeout,
+		Concurrent:       *concurrent,
+		MaxLatency:       *maxLatency,
+		MinDownloadSpeed: *minDownloadSpeed * 1024 * 1024,
+		MinUploadSpeed:   *minUploadSpeed * 1024 * 1024,
+		FastMode:         *fastMode,
+		DedupMode:        *dedupMode,
+		Groups:           *groupsConfig,
+		UserAgent:        *userAgent,
+		FetchHeaders:     http.Header(fetchHeaders),
+		FetchTimeout:     *fetchTimeout,
+		FetchRetries:     *fetchRetries,
+		CacheDir:         *cacheDir,
+		FetchProxy:       *fetchProxy,
+		FilterExpr:       *filterExpr,
+		Countries:        *countries,
+		ExcludeCountries: *excludeCountries,
+		TopPerCountry:    *topPerCountry,
+		TopBy:            *topBy,
+		SortBy:           *sortKey,
+		ScoreWeights:     weights,
+		StageTopK:        *stageTopK,
+		ProbeSize:        *probeSize,
+		ProbeMinSpeed:    *probeMinSpeed * 1024 * 1024,
+		TrafficBudget:    budget,
+		Payload:          *payloadMode,
+		VerifyPayload:    *verifyPayload,
+		AcceptStatus:     statusCodes,
+		ServerToken:      *serverToken,
+		PingCount:        *pingCount,
+		UDPEcho:          *udpEcho,
+		StreamServer:     *streamServer,
+		StreamDuration:   *streamDuration,
+		Normalize:        *baselinePercent,
+	}
+	if historyStore != nil {
+		config.Stability = historyStore.Stability(*historyWindow)
+	}
+	return config
+}
+
+// runDaemon 周期测速并在 -metrics-listen 上提供 /metrics，直到收到退出信号
+func runDaemon(metricsExporter *exporter.Exporter) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsExporter)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+	server := &http.Server{
+		Addr:              *metricsListen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go metricsExporter.Run(ctx)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("metrics server listening on %s\n", *metricsListen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
 func printResults(results []*speedtester.Result) {
 	table := tablewriter.NewWriter(os.Stdout)
 
@@ -120,6 +434,8 @@ func printResults(results []*speedtester.Result) {
 			"节点名称",
 			"类型",
 			"延迟",
+			"流量",
+			"评分",
 		}
 	} else {
 		headers = []string{
@@ -131,8 +447,16 @@ func printResults(results []*speedtester.Result) {
 			"丢包率",
 			"下载速度",
 			"上传速度",
+			"流量",
+			"评分",
 		}
 	}
+	if *udpEcho != "" {
+		headers = slices.Insert(headers, len(headers)-2, "UDP延迟", "UDP丢包率")
+	}
+	if *streamServer != "" && !*fastMode {
+		headers = slices.Insert(headers, len(headers)-2, "TCP下载", "TCP上传")
+	}
 	table.SetHeader(headers)
 	table.SetAutoWrapText(false)
 	table.SetAutoFormatHeaders(true)
@@ -155,6 +479,7 @@ func printResults(results []*speedtester.Result) {
 		table.SetColMinWidth(6, 12) // 下载速度
 		table.SetColMinWidth(7, 12) // 上传速度
 	}
+	table.SetColMinWidth(len(headers)-1, 6) // 评分
 
 	for i, result := range results {
 		idStr := fmt.Sprintf("%d.", i+1)
@@ -213,6 +538,23 @@ func printResults(results []*speedtester.Result) {
 		} else {
 			uploadSpeedStr = colorRed + uploadSpeedStr + colorReset
 		}
+		// 相对直连基准的百分比
+		if result.LatencyPercent > 0 {
+			latencyStr += fmt.Sprintf(" (%.0f%%)", result.LatencyPercent)
+		}
+		if result.DownloadPercent > 0 {
+			downloadSpeedStr += fmt.Sprintf(" (%.0f%%)", result.DownloadPercent)
+		}
+		if result.UploadPercent > 0 {
+			uploadSpeedStr += fmt.Sprintf(" (%.0f%%)", result.UploadPercent)
+		}
+		udpLatencyStr, udpPacketLossStr := "N/A", "N/A"
+		if result.UDPLatency > 0 {
+			udpLatencyStr = fmt.Sprintf("%dms", result.UDPLatency.Milliseconds())
+		}
+		if result.UDPLatency > 0 || result.UDPPacketLoss > 0 {
+			udpPacketLossStr = fmt.Sprintf("%.1f%%", result.UDPPacketLoss)
+		}
 		var row []string
 		if *fastMode {
 			row = []string{
@@ -220,6 +562,8 @@ func printResults(results []*speedtester.Result) {
 				result.ProxyName,
 				result.ProxyType,
 				latencyStr,
+				result.FormatTraffic(),
+				result.FormatScore(),
 			}
 		} else {
 			row = []string{
@@ -231,8 +575,16 @@ func printResults(results []*speedtester.Result) {
 				packetLossStr,
 				downloadSpeedStr,
 				uploadSpeedStr,
+				result.FormatTraffic(),
+				result.FormatScore(),
 			}
 		}
+		if *udpEcho != "" {
+			row = slices.Insert(row, len(row)-2, udpLatencyStr, udpPacketLossStr)
+		}
+		if *streamServer != "" && !*fastMode {
+			row = slices.Insert(row, len(row)-2, speedtester.FormatSpeed(result.StreamDownloadSpeed), speedtester.FormatSpeed(result.StreamUploadSpeed))
+		}
 
 		table.Append(row)
 	}
@@ -241,28 +593,270 @@ func printResults(results []*speedtester.Result) {
 	fmt.Println()
 }
 
-func saveConfig(results []*speedtester.Result, speedTester *speedtester.SpeedTester) error {
-	proxies := make([]map[string]any, 0)
+// printBaseline 输出直连基准，不满足延迟和速度要求时提示节点的结果可能受本地网络限制
+func printBaseline(speedTester *speedtester.SpeedTester, baseline *speedtester.Result) {
+	if *fastMode {
+		fmt.Printf("直连基准：延迟 %s\n", baseline.FormatLatency())
+	} else {
+		fmt.Printf("直连基准：延迟 %s，下载 %s，上传 %s\n", baseline.FormatLatency(), baseline.FormatDownloadSpeed(), baseline.FormatUploadSpeed())
+	}
+	if issues := speedTester.BaselineIssues(baseline); len(issues) > 0 {
+		fmt.Printf("%s%s，节点的测试结果可能受本地网络限制%s\n", colorYellow, strings.Join(issues, "；"), colorReset)
+	}
+}
 
-	// Filter results first
-	var validResults []*speedtester.Result
+// printTrafficEstimate 输出测试前预估的最大流量消耗
+func printTrafficEstimate(estimate, budget int64) {
+	if budget > 0 {
+		fmt.Printf("预计最多消耗流量 %s，流量预算 %s\n", speedtester.FormatBytes(estimate), speedtester.FormatBytes(budget))
+		return
+	}
+	fmt.Printf("预计最多消耗流量 %s\n", speedtester.FormatBytes(estimate))
+}
+
+// printTrafficUsage 输出本次测试实际消耗的流量，以及因流量预算不足跳过带宽测试的节点数
+func printTrafficUsage(speedTester *speedtester.SpeedTester, results []*speedtester.Result, budget int64) {
+	sent, received := speedTester.TrafficUsed()
+	fmt.Printf("共消耗流量 %s（发送 %s，接收 %s）\n", speedtester.FormatBytes(sent+received), speedtester.FormatBytes(sent), speedtester.FormatBytes(received))
+	var skipped int
+	for _, result := range results {
+		if result.BudgetExceeded {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		fmt.Printf("%s已达到流量预算 %s，%d 个节点跳过了带宽测试%s\n", colorYellow, speedtester.FormatBytes(budget), skipped, colorReset)
+	}
+}
+
+// printFailReasons 输出未通过响应校验的节点，这些节点可能被劫持、拦截或截断
+func printFailReasons(results []*speedtester.Result) {
 	for _, result := range results {
-		if *maxLatency > 0 && result.Latency > *maxLatency {
+		if result.FailReason != "" {
+			fmt.Printf("%s%s: %s%s\n", colorYellow, result.ProxyName, result.FailReason, colorReset)
+		}
+	}
+}
+
+// parseStatusCodes 解析逗号分隔的状态码
+func parseStatusCodes(s string) ([]int, error) {
+	var codes []int
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
 			continue
 		}
-		if result.Latency == 0 {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", item)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// printStageSummary 输出分阶段测试中通过每个阶段的节点数
+func printStageSummary(results []*speedtester.Result) {
+	var latency, probe, throughput int
+	for _, result := range results {
+		if result.IsRelay() {
+			continue
+		}
+		if result.Stage >= speedtester.StageLatency {
+			latency++
+		}
+		if result.Stage >= speedtester.StageProbe {
+			probe++
+		}
+		if result.Stage >= speedtester.StageThroughput {
+			throughput++
+		}
+	}
+	fmt.Printf("分阶段测试: %d 个节点通过延迟测试，%d 个通过短测速，%d 个完成完整测速\n\n", latency, probe, throughput)
+}
+
+// printHopLatencies 输出链式节点每一跳的延迟
+func printHopLatencies(results []*speedtester.Result) {
+	for _, result := range results {
+		if len(result.HopLatencies) == 0 {
+			continue
+		}
+		hops := make([]string, 0, len(result.HopLatencies))
+		for _, hop := range result.HopLatencies {
+			hops = append(hops, fmt.Sprintf("%s %dms (+%dms)", hop.Name, hop.Latency.Milliseconds(), hop.Added.Milliseconds()))
+		}
+		fmt.Printf("%s: %s\n", result.ProxyName, strings.Join(hops, " -> "))
+	}
+}
+
+// printStreamIntervals 输出原始 TCP 测速每个区间的速度
+func printStreamIntervals(results []*speedtester.Result) {
+	for _, result := range results {
+		if len(result.StreamDownloadIntervals) == 0 && len(result.StreamUploadIntervals) == 0 {
 			continue
 		}
-		if !*fastMode {
-			if *downloadSize > 0 && *minDownloadSpeed > 0 && result.DownloadSpeed < *minDownloadSpeed*1024*1024 {
+		fmt.Printf("%s:\n", result.ProxyName)
+		for _, line := range []struct {
+			name      string
+			intervals []float64
+		}{
+			{"  下载", result.StreamDownloadIntervals},
+			{"  上传", result.StreamUploadIntervals},
+		} {
+			if len(line.intervals) == 0 {
 				continue
 			}
-			if *uploadSize > 0 && *minUploadSpeed > 0 && result.UploadSpeed < *minUploadSpeed*1024*1024 {
-				continue
+			speeds := make([]string, 0, len(line.intervals))
+			for _, speed := range line.intervals {
+				speeds = append(speeds, speedtester.FormatSpeed(speed))
 			}
+			fmt.Printf("%s: %s\n", line.name, strings.Join(speeds, " "))
+		}
+	}
+}
+
+func printGroupReports(reports []*speedtester.GroupReport) {
+	table := newPlainTable([]string{"策略组", "类型", "节点数", "已测试", "可用", "覆盖率", "选中节点", "延迟"})
+	for _, report := range reports {
+		aliveStr := fmt.Sprintf("%d", report.Alive)
+		if report.Alive == 0 {
+			aliveStr = colorRed + aliveStr + colorReset
+		} else {
+			aliveStr = colorGreen + aliveStr + colorReset
+		}
+		latencyStr := "N/A"
+		if report.Latency > 0 {
+			latencyStr = fmt.Sprintf("%dms", report.Latency.Milliseconds())
+		}
+		table.Append([]string{
+			report.Name,
+			report.Type,
+			fmt.Sprintf("%d", report.Total),
+			fmt.Sprintf("%d", report.Tested),
+			aliveStr,
+			fmt.Sprintf("%.1f%%", report.Coverage),
+			report.Selected,
+			latencyStr,
+		})
+	}
+	table.Render()
+	fmt.Println()
+}
+
+// printLintIssues 输出静态检查发现的问题，返回错误数
+func printLintIssues(issues []*speedtester.LintIssue) int {
+	var errorCount, warningCount int
+	if len(issues) > 0 {
+		table := newPlainTable([]string{"级别", "来源", "Provider", "位置", "节点名称", "问题"})
+		for _, issue := range issues {
+			level := colorYellow + issue.Level + colorReset
+			if issue.Level == speedtester.LintError {
+				level = colorRed + issue.Level + colorReset
+				errorCount++
+			} else {
+				warningCount++
+			}
+			index := ""
+			if issue.Index >= 0 {
+				index = fmt.Sprintf("%d", issue.Index)
+			}
+			table.Append([]string{level, issue.Source, issue.Provider, index, issue.Name, issue.Message})
+		}
+		table.Render()
+		fmt.Println()
+	}
+	fmt.Printf("%d errors, %d warnings\n", errorCount, warningCount)
+	return errorCount
+}
+
+// printSourceSummaries 按配置来源和 provider 输出加载和测试情况
+func printSourceSummaries(summaries []*speedtester.SourceSummary) {
+	table := newPlainTable([]string{"来源", "Provider", "加载", "解析失败", "已测试", "通过", "延迟中位数", "下载中位数"})
+	for _, summary := range summaries {
+		// 只使用 provider 的配置没有直接定义的节点，不单独列出
+		if summary.Provider == "" && summary.Loaded == 0 && summary.ParseFailed == 0 && summary.Error == "" {
+			continue
+		}
+		passedStr := fmt.Sprintf("%d", summary.Passed)
+		if summary.Passed == 0 {
+			passedStr = colorRed + passedStr + colorReset
+		} else {
+			passedStr = colorGreen + passedStr + colorReset
+		}
+		latencyStr, downloadStr := "N/A", "N/A"
+		if summary.MedianLatency > 0 {
+			latencyStr = fmt.Sprintf("%dms", summary.MedianLatency.Milliseconds())
+		}
+		if summary.MedianDownload > 0 {
+			downloadStr = speedtester.FormatSpeed(summary.MedianDownload)
+		}
+		row := []string{
+			summary.Source,
+			summary.Provider,
+			fmt.Sprintf("%d", summary.Loaded),
+			fmt.Sprintf("%d", summary.ParseFailed),
+			fmt.Sprintf("%d", summary.Tested),
+			passedStr,
+			latencyStr,
+			downloadStr,
+		}
+		if summary.Error != "" {
+			row = []string{summary.Source, summary.Provider, colorRed + summary.Error + colorReset, "", "", "", "", ""}
+		}
+		table.Append(row)
+	}
+	table.Render()
+	fmt.Println()
+}
+
+// printSubscriptions 输出订阅的剩余流量和到期时间，即将到期或流量不足时给出提醒
+func printSubscriptions(subs []*speedtester.SubscriptionInfo) {
+	table := newPlainTable([]string{"订阅", "Provider", "已用", "总流量", "剩余", "到期时间"})
+	var warnings []string
+	now := time.Now()
+	for _, sub := range subs {
+		totalStr, remainingStr := "N/A", "N/A"
+		if remaining := sub.Remaining(); remaining >= 0 {
+			totalStr = speedtester.FormatBytes(sub.Total)
+			remainingStr = speedtester.FormatBytes(remaining)
+		}
+		expireStr := "长期有效"
+		if !sub.Expire.IsZero() {
+			expireStr = sub.Expire.Format(time.DateOnly)
+		}
+		subWarnings := sub.Warnings(now)
+		if len(subWarnings) > 0 {
+			remainingStr = colorYellow + remainingStr + colorReset
+			expireStr = colorYellow + expireStr + colorReset
+		}
+		for _, warning := range subWarnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", sub.Source, warning))
+		}
+		table.Append([]string{
+			sub.Source,
+			sub.Provider,
+			speedtester.FormatBytes(sub.Used()),
+			totalStr,
+			remainingStr,
+			expireStr,
+		})
+	}
+	table.Render()
+	for _, warning := range warnings {
+		fmt.Println(colorYellow + "warning: " + warning + colorReset)
+	}
+	fmt.Println()
+}
+
+func saveConfig(results []*speedtester.Result, speedTester *speedtester.SpeedTester) error {
+	// Filter results first
+	var validResults []*speedtester.Result
+	for _, result := range results {
+		if result.IsRelay() || !speedTester.Passed(result) {
+			continue
 		}
 		validResults = append(validResults, result)
 	}
+	validResults = speedTester.SelectTopPerCountry(validResults)
 	if *renameNodes {
 		var wg sync.WaitGroup
 		semaphore := make(chan struct{}, *concurrent)
@@ -294,12 +888,11 @@ func saveConfig(results []*speedtester.Result, speedTester *speedtester.SpeedTes
 		wg.Wait()
 	}
 
-	for _, result := range validResults {
-		proxies = append(proxies, result.ProxyConfig)
-	}
+	proxies := speedtester.OutputProxies(validResults)
 
 	config := &speedtester.RawConfig{
-		Proxies: proxies,
+		Proxies:     proxies,
+		ProxyGroups: speedtester.BuildProxyGroups(speedTester.Groups(), validResults),
 	}
 	if len(proxies) == 0 {
 		log.Warnln("No proxy available,No output!")
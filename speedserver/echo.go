@@ -0,0 +1,114 @@
+package speedserver
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// echoIdleTimeout 是 echo 连接的空闲超时
+const echoIdleTimeout = time.Minute
+
+// handlePing 返回空响应，用于测量 HTTP 延迟
+func (h *Handler) handlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWS 是 WebSocket echo，客户端在同一个连接上重复发送消息测量往返延迟和抖动。
+// 先读取帧头，超过 maxEchoMessage 的帧在读取内容前拒绝，不支持分片消息
+func (h *Handler) handleWS(w http.ResponseWriter, r *http.Request) {
+	conn, rw, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(echoIdleTimeout))
+		header, err := ws.ReadHeader(rw.Reader)
+		if err != nil {
+			return
+		}
+		if header.Length > maxEchoMessage {
+			ws.WriteFrame(conn, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusMessageTooBig, "")))
+			return
+		}
+		payload := make([]byte, header.Length)
+		if _, err := io.ReadFull(rw.Reader, payload); err != nil {
+			return
+		}
+		if header.Masked {
+			ws.Cipher(payload, header.Mask, 0)
+		}
+
+		var reply ws.Frame
+		switch {
+		case header.OpCode == ws.OpPing:
+			reply = ws.NewPongFrame(payload)
+		case header.OpCode == ws.OpPong:
+			continue
+		case (header.OpCode == ws.OpText || header.OpCode == ws.OpBinary) && header.Fin:
+			reply = ws.NewFrame(header.OpCode, true, payload)
+		default:
+			// 关闭帧、分片消息
+			return
+		}
+		// 帧头和内容一起发送，分开写入会因 Nagle 算法增加延迟
+		if err := ws.WriteFrame(rw.Writer, reply); err != nil || rw.Writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// maxEchoMessage 是 WebSocket 和 UDP echo 单个消息的最大字节数
+const maxEchoMessage = 64 * 1024
+
+// ServeTCPEcho 在 addr 上原样返回收到的数据
+func ServeTCPEcho(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("tcp echo listening on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(echoIdleTimeout))
+			io.Copy(conn, io.LimitReader(conn, 1024*1024*1024))
+		}()
+	}
+}
+
+// ServeUDPEcho 在 addr 上将收到的数据包原样发回。UDP 的来源地址可以伪造，
+// 每个数据包按一次请求计入 RateLimit，超过限制的来源的数据包直接丢弃，避免被用作反射攻击的跳板
+func (h *Handler) ServeUDPEcho(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("udp echo listening on %s", addr)
+	if h.limiter == nil {
+		log.Printf("udp echo has no rate limit and can be abused as a reflector, do not expose it publicly without -rate-limit")
+	}
+	buf := make([]byte, maxEchoMessage)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if h.limiter != nil {
+			if udpAddr, ok := peer.(*net.UDPAddr); ok && !h.limiter.allow(udpAddr.IP.String()) {
+				continue
+			}
+		}
+		conn.WriteTo(buf[:n], peer)
+	}
+}
@@ -0,0 +1,239 @@
+// Package speedserver 实现 clash-speedtest 的测速服务器，由 download-server 和 Web 模式共用
+package speedserver
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+)
+
+// Config 是测速服务器的配置
+type Config struct {
+	Payload   string // /__down 返回的内容，见 speedtester.Payload*
+	Token     string // 非空时 /__down、/__up 和 /ws 需要 Authorization: Bearer <Token>，原始 TCP 测速需要用 Token 计算的 MAC
+	MaxBytes  int64  // 单个请求最多下载或上传的字节数，0 表示不限制
+	RateLimit int    // 每个客户端 IP 每分钟最多的请求数，0 表示不限制
+	AccessLog bool   // 记录每个请求
+}
+
+// Handler 提供与 Cloudflare 测速服务兼容的 /__down 和 /__up，以及测量延迟的 /ping 和 WebSocket echo /ws
+type Handler struct {
+	config  *Config
+	mux     *http.ServeMux
+	limiter *rateLimiter
+}
+
+// Paths 是 Handler 提供的测速接口，挂载到其他服务器时使用
+var Paths = []string{"/__down", "/__up", "/ping", "/ws"}
+
+// New 创建测速服务器处理器，原始 TCP 测速和 echo 服务需另外启动，见 ServeStream、ServeTCPEcho、ServeUDPEcho
+func New(config *Config) *Handler {
+	h := &Handler{config: config, mux: http.NewServeMux()}
+	if config.RateLimit > 0 {
+		h.limiter = newRateLimiter(config.RateLimit, time.Minute)
+	}
+	h.mux.HandleFunc("/", h.handleIndex)
+	h.mux.HandleFunc("/__down", h.protect(h.handleDown))
+	h.mux.HandleFunc("/__up", h.protect(h.handleUp))
+	h.mux.HandleFunc("/ping", h.handlePing)
+	h.mux.HandleFunc("/ws", h.protect(h.handleWS))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	// 与 Cloudflare 一样允许浏览器跨域测速并读取 Server-Timing
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Timing-Allow-Origin", "*")
+	h.mux.ServeHTTP(rw, r)
+	if h.config.AccessLog {
+		log.Printf("%s %s %s %d sent=%d received=%d %s measId=%s", clientIP(r), r.Method, r.URL.Path, rw.status,
+			rw.bytes, body.n, time.Since(start).Round(time.Millisecond), r.URL.Query().Get("measId"))
+	}
+}
+
+// protect 检查身份验证和请求频率
+func (h *Handler) protect(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.config.Token != "" && !validToken(r.Header.Get("Authorization"), h.config.Token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if h.limiter != nil && !h.limiter.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *Handler) handleIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`<h1>SpeedTest Server</h1>`))
+}
+
+func (h *Handler) handleDown(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	byteSize, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+	if err != nil || byteSize < 0 {
+		http.Error(w, fmt.Sprintf("invalid bytes %q", r.URL.Query().Get("bytes")), http.StatusBadRequest)
+		return
+	}
+	if h.config.MaxBytes > 0 && int64(byteSize) > h.config.MaxBytes {
+		http.Error(w, fmt.Sprintf("bytes exceeds limit %d", h.config.MaxBytes), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=speedtest-%d.bin", byteSize))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(byteSize))
+	w.Header().Set("Server-Timing", serverTiming("cfRequestDuration", time.Since(start)))
+	w.WriteHeader(http.StatusOK)
+
+	var reader io.Reader = speedtester.NewZeroReader(byteSize)
+	if h.config.Payload == speedtester.PayloadRandom {
+		seed, _ := strconv.ParseUint(r.URL.Query().Get("seed"), 10, 64)
+		reader = speedtester.NewRandomReader(byteSize, seed)
+	}
+	io.Copy(w, reader)
+}
+
+func (h *Handler) handleUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 返回实际收到的字节数和接收时长，测速端据此计算上传速度
+	start := time.Now()
+	body := r.Body
+	if h.config.MaxBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.config.MaxBytes)
+	}
+	n, err := io.Copy(io.Discard, body)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		http.Error(w, fmt.Sprintf("body exceeds limit %d", h.config.MaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	duration := time.Since(start)
+	receipt := speedtester.UploadReceipt{
+		Bytes:      n,
+		DurationMs: float64(duration.Microseconds()) / 1000,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Server-Timing", serverTiming("recv", duration))
+	w.Header().Add("Server-Timing", serverTiming("cfRequestDuration", duration))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(receipt)
+}
+
+func serverTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d.Microseconds())/1000)
+}
+
+func validToken(authHeader, token string) bool {
+	scheme, value, ok := strings.Cut(authHeader, " ")
+	return ok && scheme == "Bearer" && subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// statusWriter 记录响应的状态码和字节数，用于访问日志
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack 供 /ws 升级连接使用，此后的流量不计入访问日志
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody 记录读取的请求体字节数，用于访问日志
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// rateLimiter 按固定时间窗口限制每个客户端的请求数
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: make(map[string]int)}
+}
+
+func (l *rateLimiter) allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := time.Now(); now.Sub(l.windowStart) >= l.window {
+		l.windowStart = now
+		clear(l.counts)
+	}
+	if l.counts[client] >= l.limit {
+		return false
+	}
+	l.counts[client]++
+	return true
+}
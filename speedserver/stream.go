@@ -0,0 +1,132 @@
+package speedserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/faceair/clash-speedtest/speedtester"
+)
+
+// maxStreamDuration 是原始 TCP 测速单个方向允许的最长时长
+const maxStreamDuration = time.Minute
+
+// ServeStream 在 addr 上提供原始 TCP 测速，协议见 speedtester.StreamRequest
+func (h *Handler) ServeStream(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("stream server listening on %s", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handleStream(conn)
+	}
+}
+
+func (h *Handler) handleStream(conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	conn.SetDeadline(start.Add(10 * time.Second))
+	challenge, nonce := speedtester.NewStreamChallenge()
+	if _, err := io.WriteString(conn, challenge); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	request, err := speedtester.ParseStreamRequest(string(line))
+	switch {
+	case err != nil:
+	case !request.Verify(h.config.Token, nonce):
+		err = fmt.Errorf("unauthorized")
+	case request.Duration > maxStreamDuration:
+		err = fmt.Errorf("duration exceeds limit %s", maxStreamDuration)
+	case h.limiter != nil && !h.limiter.allow(client):
+		err = fmt.Errorf("too many requests")
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "ERR %v\n", err)
+		if h.config.AccessLog {
+			log.Printf("%s STREAM rejected: %v", client, err)
+		}
+		return
+	}
+	if _, err := io.WriteString(conn, "OK\n"); err != nil {
+		return
+	}
+
+	var sent, received int64
+	if request.Direction == speedtester.StreamDown {
+		sent = h.sendStream(conn, request.Duration)
+	} else {
+		received = h.receiveStream(conn, reader, request.Duration)
+	}
+	if h.config.AccessLog {
+		log.Printf("%s STREAM %s sent=%d received=%d %s", client, request.Direction, sent, received, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// sendStream 持续发送不可压缩的数据，直到 duration 结束或达到 MaxBytes
+func (h *Handler) sendStream(conn net.Conn, duration time.Duration) int64 {
+	payload := speedtester.NewRandomReader(math.MaxInt, rand.Uint64())
+	buf := make([]byte, 32*1024)
+	conn.SetDeadline(time.Now().Add(duration))
+	var sent int64
+	for h.config.MaxBytes <= 0 || sent < h.config.MaxBytes {
+		payload.Read(buf)
+		n, err := conn.Write(buf)
+		sent += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	return sent
+}
+
+// receiveStream 接收 duration 内的数据并按 StreamInterval 统计，结束后返回 StreamReport
+func (h *Handler) receiveStream(conn net.Conn, reader io.Reader, duration time.Duration) int64 {
+	report := speedtester.StreamReport{Intervals: make([]int64, speedtester.StreamIntervals(duration))}
+	buf := make([]byte, 32*1024)
+	start := time.Now()
+	conn.SetDeadline(start.Add(duration))
+	for h.config.MaxBytes <= 0 || report.Bytes < h.config.MaxBytes {
+		n, err := reader.Read(buf)
+		if i := int(time.Since(start) / speedtester.StreamInterval); i < len(report.Intervals) {
+			report.Intervals[i] += int64(n)
+		}
+		report.Bytes += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+	report.DurationMs = float64(elapsed.Microseconds()) / 1000
+	// 提前结束时只保留完整的区间
+	report.Intervals = report.Intervals[:min(len(report.Intervals), speedtester.StreamIntervals(elapsed))]
+
+	conn.SetDeadline(time.Now().Add(echoIdleTimeout))
+	if err := json.NewEncoder(conn).Encode(report); err != nil {
+		return report.Bytes
+	}
+	// 客户端在收到统计前可能仍在发送，读完剩余数据再关闭，避免连接被重置导致统计丢失
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, reader)
+	return report.Bytes
+}
@@ -0,0 +1,73 @@
+package speedtester
+
+import (
+	"fmt"
+
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/adapter/outbound"
+)
+
+// BaselineName 是直连基准结果的节点名称
+const BaselineName = "DIRECT"
+
+// TestBaseline 不经过代理，用与节点相同的测试（同样通过 createClient）测量本机直连测速服务器的延迟和速度，
+// 用于区分节点慢还是本地网络慢。需在 LoadProxies 之后调用，直连的流量不计入 TrafficUsed 和流量预算。
+// Normalize 开启时，之后 TestProxies 的结果按此基准计算百分比
+func (st *SpeedTester) TestBaseline() *Result {
+	direct := &CProxy{Proxy: adapter.NewProxy(outbound.NewDirect())}
+	result := st.testProxy(BaselineName, direct)
+	if result == nil {
+		result = &Result{ProxyName: BaselineName, ProxyType: direct.Type().String()}
+	}
+	if result.usage != nil {
+		result.BytesSent = result.usage.sent.Load()
+		result.BytesReceived = result.usage.received.Load()
+		st.traffic.sent.Add(-result.BytesSent)
+		st.traffic.received.Add(-result.BytesReceived)
+	}
+	st.baseline = result
+	return result
+}
+
+// BaselineIssues 检查直连基准是否满足配置的延迟和速度要求，不满足时节点的结果可能受本地网络限制
+func (st *SpeedTester) BaselineIssues(baseline *Result) []string {
+	var issues []string
+	if baseline.Latency == 0 {
+		issue := "直连测速服务器失败"
+		if baseline.FailReason != "" {
+			issue += "：" + baseline.FailReason
+		}
+		return append(issues, issue)
+	}
+	if st.config.MaxLatency > 0 && baseline.Latency > st.config.MaxLatency {
+		issues = append(issues, fmt.Sprintf("直连延迟 %s 超过最大延迟 %dms", baseline.FormatLatency(), st.config.MaxLatency.Milliseconds()))
+	}
+	if st.config.FastMode {
+		return issues
+	}
+	if st.config.DownloadSize > 0 && baseline.DownloadSpeed < st.config.MinDownloadSpeed {
+		issues = append(issues, fmt.Sprintf("直连下载速度 %s 低于最低要求 %s", baseline.FormatDownloadSpeed(), FormatSpeed(st.config.MinDownloadSpeed)))
+	}
+	// 下载速度不达标时不会测试上传
+	if baseline.UploadSize > 0 && baseline.UploadSpeed < st.config.MinUploadSpeed {
+		issues = append(issues, fmt.Sprintf("直连上传速度 %s 低于最低要求 %s", baseline.FormatUploadSpeed(), FormatSpeed(st.config.MinUploadSpeed)))
+	}
+	return issues
+}
+
+// normalize 按直连基准计算结果的百分比，基准或结果缺少对应数据时为 0
+func (st *SpeedTester) normalize(result *Result) {
+	baseline := st.baseline
+	if !st.config.Normalize || baseline == nil {
+		return
+	}
+	if result.Latency > 0 && baseline.Latency > 0 {
+		result.LatencyPercent = float64(result.Latency) / float64(baseline.Latency) * 100
+	}
+	if result.DownloadSpeed > 0 && baseline.DownloadSpeed > 0 {
+		result.DownloadPercent = result.DownloadSpeed / baseline.DownloadSpeed * 100
+	}
+	if result.UploadSpeed > 0 && baseline.UploadSpeed > 0 {
+		result.UploadPercent = result.UploadSpeed / baseline.UploadSpeed * 100
+	}
+}
@@ -0,0 +1,320 @@
+package speedtester
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/metacubex/mihomo/component/dialer"
+	"github.com/metacubex/mihomo/component/proxydialer"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+)
+
+// chainedProxy 先经过 upstream 再连接到 Proxy，用于 dialer-proxy 和 relay。
+// mihomo 本身通过全局的 tunnel 按名称查找 dialer-proxy，这里在加载时直接组装，多个来源之间互不影响
+type chainedProxy struct {
+	constant.Proxy
+	upstream constant.Proxy
+}
+
+func (c *chainedProxy) DialContext(ctx context.Context, metadata *constant.Metadata) (constant.Conn, error) {
+	d := proxydialer.New(c.upstream, dialer.NewDialer(), false)
+	return c.Proxy.DialContextWithDialer(ctx, d, metadata)
+}
+
+func (c *chainedProxy) ListenPacketContext(ctx context.Context, metadata *constant.Metadata) (constant.PacketConn, error) {
+	d := proxydialer.New(c.upstream, dialer.NewDialer(), false)
+	return c.Proxy.ListenPacketWithDialer(ctx, d, metadata)
+}
+
+// relayProxy 表示 relay 策略组组装出的链路，名称和类型取自策略组
+type relayProxy struct {
+	constant.Proxy
+	name string
+}
+
+func (r *relayProxy) Name() string {
+	return r.name
+}
+
+func (r *relayProxy) Type() constant.AdapterType {
+	return constant.Relay
+}
+
+// chainHop 表示链路中的一跳，proxy 为从第一跳到这一跳组装出的代理
+type chainHop struct {
+	name  string
+	proxy constant.Proxy
+}
+
+// HopLatency 表示链路中到达某一跳的延迟
+type HopLatency struct {
+	Name    string        `json:"name"`
+	Latency time.Duration `json:"latency"` // 从本地经过前面所有跳到达这一跳的延迟
+	Added   time.Duration `json:"added"`   // 这一跳增加的延迟
+}
+
+// chainBuilder 为单个配置来源解析 dialer-proxy 和 relay
+type chainBuilder struct {
+	src      *groupSource
+	configs  map[string]map[string]any // 策略组名 -> 配置
+	resolved map[*CProxy][]chainHop
+	visiting map[*CProxy]bool
+	issues   []*LintIssue // 无法组装的节点和 relay 策略组
+}
+
+func newChainBuilder(src *groupSource, groupsConfig []map[string]any) *chainBuilder {
+	configs := make(map[string]map[string]any, len(groupsConfig))
+	for _, config := range groupsConfig {
+		if name, ok := config["name"].(string); ok {
+			configs[name] = config
+		}
+	}
+	return &chainBuilder{
+		src:      src,
+		configs:  configs,
+		resolved: make(map[*CProxy][]chainHop),
+		visiting: make(map[*CProxy]bool),
+	}
+}
+
+// lookup 按名称查找节点；名称为策略组时取展开后的第一个节点，与 select 的默认选择一致
+func (b *chainBuilder) lookup(name string) (*CProxy, error) {
+	for _, m := range b.src.proxies {
+		if m.name == name {
+			return m.proxy, nil
+		}
+	}
+	if _, ok := b.configs[name]; ok {
+		members := expandGroup(b.src, b.configs, name, map[string]bool{})
+		if len(members) == 0 {
+			return nil, fmt.Errorf("proxy group %s has no proxies", name)
+		}
+		return members[0].proxy, nil
+	}
+	return nil, fmt.Errorf("proxy %s not found", name)
+}
+
+// resolve 返回节点完整的链路，第一跳在前
+func (b *chainBuilder) resolve(p *CProxy) ([]chainHop, error) {
+	if hops, ok := b.resolved[p]; ok {
+		return hops, nil
+	}
+	if p.dialerProxy == "" {
+		return []chainHop{{name: p.Name(), proxy: p.Proxy}}, nil
+	}
+	if b.visiting[p] {
+		return nil, fmt.Errorf("circular dialer-proxy at %s", p.Name())
+	}
+	b.visiting[p] = true
+	defer delete(b.visiting, p)
+
+	upstream, err := b.lookup(p.dialerProxy)
+	if err != nil {
+		return nil, err
+	}
+	upstreamHops, err := b.resolve(upstream)
+	if err != nil {
+		return nil, err
+	}
+	p.upstream = upstream
+
+	hops := append([]chainHop{}, upstreamHops...)
+	hops = append(hops, chainHop{
+		name: p.Name(),
+		proxy: &chainedProxy{
+			Proxy:    p.Proxy,
+			upstream: upstreamHops[len(upstreamHops)-1].proxy,
+		},
+	})
+	b.resolved[p] = hops
+	return hops, nil
+}
+
+// applyDialerProxies 为所有设置了 dialer-proxy 的节点组装链路，无法解析的节点被移除
+func (b *chainBuilder) applyDialerProxies(proxies map[string]*CProxy) {
+	for name, p := range proxies {
+		if p.dialerProxy == "" {
+			continue
+		}
+		hops, err := b.resolve(p)
+		if err != nil {
+			log.Warnln("Skip proxy %s: %v", name, err)
+			b.issues = append(b.issues, &LintIssue{
+				Level:    LintError,
+				Source:   RedactSource(p.Source),
+				Provider: p.Provider,
+				Index:    p.Index,
+				Name:     name,
+				Message:  fmt.Sprintf("dialer-proxy: %v", err),
+			})
+			delete(proxies, name)
+			continue
+		}
+		p.setHops(hops)
+	}
+}
+
+// buildRelays 为 relay 策略组组装链路节点
+func (b *chainBuilder) buildRelays(groupsConfig []map[string]any, source string) []*CProxy {
+	var relays []*CProxy
+	for _, config := range groupsConfig {
+		groupType, _ := config["type"].(string)
+		name, _ := config["name"].(string)
+		if groupType != GroupRelay || name == "" {
+			continue
+		}
+
+		var hops []chainHop
+		var err error
+		for _, ref := range toStringSlice(config["proxies"]) {
+			var member *CProxy
+			member, err = b.lookup(ref)
+			if err != nil {
+				break
+			}
+			if len(hops) == 0 {
+				// 第一跳保留其自身的 dialer-proxy 链路
+				hops, err = b.resolve(member)
+				if err != nil {
+					break
+				}
+				continue
+			}
+			hops = append(hops, chainHop{
+				name: member.Name(),
+				proxy: &chainedProxy{
+					Proxy:    member.Proxy,
+					upstream: hops[len(hops)-1].proxy,
+				},
+			})
+		}
+		if err == nil && len(hops) == 0 {
+			err = fmt.Errorf("no proxies")
+		}
+		if err != nil {
+			log.Warnln("Skip relay group %s: %v", name, err)
+			b.issues = append(b.issues, &LintIssue{
+				Level:   LintError,
+				Source:  RedactSource(source),
+				Index:   -1,
+				Name:    name,
+				Message: fmt.Sprintf("relay group: %v", err),
+			})
+			continue
+		}
+
+		relay := &CProxy{
+			Proxy:  &relayProxy{Proxy: hops[len(hops)-1].proxy, name: name},
+			Config: config,
+			Source: source,
+		}
+		relay.setHops(hops)
+		relays = append(relays, relay)
+	}
+	return relays
+}
+
+func (p *CProxy) setHops(hops []chainHop) {
+	p.hops = hops
+	p.Chain = make([]string, 0, len(hops))
+	for _, hop := range hops {
+		p.Chain = append(p.Chain, hop.name)
+	}
+	if _, ok := p.Proxy.(*relayProxy); !ok {
+		p.Proxy = hops[len(hops)-1].proxy
+	}
+}
+
+// OutputProxies 返回写入配置文件的节点配置。设置了 dialer-proxy 的节点，其上游节点可能被过滤、未通过测试或被重命名，
+// 这里把不在 results 中的上游节点一并写入，并把 dialer-proxy 改为上游节点最终的名称
+func OutputProxies(results []*Result) []map[string]any {
+	proxies := make([]map[string]any, 0, len(results))
+	names := make(map[string]bool, len(results))
+	byFingerprint := make(map[string]string, len(results)) // 节点指纹 -> 输出的名称
+	for _, result := range results {
+		name, _ := result.ProxyConfig["name"].(string)
+		names[name] = true
+		byFingerprint[result.Fingerprint] = name
+	}
+
+	emitted := make(map[*CProxy]string)
+	var emit func(p *CProxy) string
+	emit = func(p *CProxy) string {
+		if name, ok := emitted[p]; ok {
+			return name
+		}
+		fingerprint := p.Fingerprint
+		if fingerprint == "" {
+			fingerprint = Fingerprint(p.Config)
+		}
+		if name, ok := byFingerprint[fingerprint]; ok {
+			emitted[p] = name
+			return name
+		}
+		name, _ := p.Config["name"].(string)
+		for base, i := name, 1; names[name]; i++ {
+			name = fmt.Sprintf("%s-上游%d", base, i)
+		}
+		names[name] = true
+		emitted[p] = name
+		config := maps.Clone(p.Config)
+		config["name"] = name
+		if p.upstream != nil {
+			config["dialer-proxy"] = emit(p.upstream)
+		}
+		proxies = append(proxies, config)
+		return name
+	}
+
+	for _, result := range results {
+		config := result.ProxyConfig
+		if result.upstream != nil {
+			config = maps.Clone(config)
+			config["dialer-proxy"] = emit(result.upstream)
+		}
+		proxies = append(proxies, config)
+	}
+	return proxies
+}
+
+// testHopLatencies 依次测量到达链路中每一跳的延迟，total 为完整链路的延迟，流量计入 usage
+func (st *SpeedTester) testHopLatencies(p *CProxy, usage *trafficCounter, url string, total time.Duration) []HopLatency {
+	latencies := make([]HopLatency, 0, len(p.hops))
+	var previous time.Duration
+	for i, hop := range p.hops {
+		latency := total
+		if i < len(p.hops)-1 {
+			var err error
+			latency, err = st.probeLatency(&meteredProxy{Proxy: hop.proxy, usage: usage}, url)
+			if err != nil {
+				break
+			}
+		}
+		latencies = append(latencies, HopLatency{
+			Name:    hop.name,
+			Latency: latency,
+			Added:   max(latency-previous, 0),
+		})
+		previous = latency
+	}
+	return latencies
+}
+
+// probeLatency 通过代理请求 url，返回收到响应头的耗时
+func (st *SpeedTester) probeLatency(proxy constant.Proxy, url string) (time.Duration, error) {
+	client := st.createClient(proxy, st.config.MaxLatency)
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	latency := time.Since(start)
+	defer resp.Body.Close()
+	if err := st.checkProbeResponse(resp); err != nil {
+		return 0, err
+	}
+	return latency, nil
+}
@@ -0,0 +1,76 @@
+package speedtester
+
+import (
+	"slices"
+	"sort"
+	"strings"
+)
+
+// parseCountries 解析逗号分隔的国家代码，统一为大写
+func parseCountries(s string) []string {
+	var countries []string
+	for _, country := range strings.Split(s, ",") {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			countries = append(countries, country)
+		}
+	}
+	return countries
+}
+
+// matchCountry 判断结果的出口国家是否满足 Countries 和 ExcludeCountries，
+// 未能查询到国家的节点不满足 Countries
+func (st *SpeedTester) matchCountry(result *Result) bool {
+	country := strings.ToUpper(result.Country)
+	if include := parseCountries(st.config.Countries); len(include) > 0 && !slices.Contains(include, country) {
+		return false
+	}
+	if exclude := parseCountries(st.config.ExcludeCountries); country != "" && slices.Contains(exclude, country) {
+		return false
+	}
+	return true
+}
+
+// topBy 返回按国家选取节点时使用的排序依据，未设置时快速模式按延迟，否则按下载速度
+func (st *SpeedTester) topBy() string {
+	if st.config.TopBy != "" {
+		return st.config.TopBy
+	}
+	if st.config.FastMode {
+		return SortByLatency
+	}
+	return SortByDownload
+}
+
+// SelectTopPerCountry 在每个出口国家中按 TopBy 选出最好的 TopPerCountry 个节点，保持 results 原有的顺序。
+// 未能查询到国家的节点归为一组。TopPerCountry 不大于 0 时原样返回
+func (st *SpeedTester) SelectTopPerCountry(results []*Result) []*Result {
+	if st.config.TopPerCountry <= 0 {
+		return results
+	}
+	less, err := resultLess(st.topBy())
+	if err != nil {
+		return results
+	}
+
+	byCountry := make(map[string][]*Result)
+	for _, result := range results {
+		country := strings.ToUpper(result.Country)
+		byCountry[country] = append(byCountry[country], result)
+	}
+	selected := make(map[*Result]bool)
+	for _, group := range byCountry {
+		sorted := append([]*Result(nil), group...)
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		for _, result := range sorted[:min(len(sorted), st.config.TopPerCountry)] {
+			selected[result] = true
+		}
+	}
+
+	output := make([]*Result, 0, len(selected))
+	for _, result := range results {
+		if selected[result] {
+			output = append(output, result)
+		}
+	}
+	return output
+}
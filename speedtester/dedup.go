@@ -0,0 +1,115 @@
+package speedtester
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+// 去重严格程度
+const (
+	DedupNone     = "none"     // 不去重
+	DedupExact    = "exact"    // 指纹完全相同
+	DedupEndpoint = "endpoint" // 服务器和端口相同
+	DedupExitIP   = "exit-ip"  // 出口 IP 相同（需要经代理联网查询）
+)
+
+// dedupKey 返回节点在当前去重模式下的标识，空字符串表示不参与去重
+func (st *SpeedTester) dedupKey(p *CProxy) string {
+	switch st.config.DedupMode {
+	case DedupNone:
+		return ""
+	case DedupEndpoint:
+		server, _ := p.Config["server"].(string)
+		if server == "" {
+			return p.Fingerprint
+		}
+		return net.JoinHostPort(strings.ToLower(server), fmt.Sprint(p.Config["port"]))
+	default:
+		return p.Fingerprint
+	}
+}
+
+// mergeDuplicate 将重复节点 dup 的名称和来源记录到保留的节点 keep 上
+func mergeDuplicate(keep *CProxy, dup *CProxy, dupName string) {
+	if !slices.Contains(keep.Aliases, dupName) {
+		keep.Aliases = append(keep.Aliases, dupName)
+	}
+	for _, alias := range dup.Aliases {
+		if !slices.Contains(keep.Aliases, alias) {
+			keep.Aliases = append(keep.Aliases, alias)
+		}
+	}
+	for _, source := range dup.Sources {
+		if !slices.Contains(keep.Sources, source) {
+			keep.Sources = append(keep.Sources, source)
+		}
+	}
+}
+
+// DuplicateCount 返回最近一次 LoadProxies 合并掉的重复节点数
+func (st *SpeedTester) DuplicateCount() int {
+	return st.duplicateCount
+}
+
+// dedupByExitIP 经由每个节点查询出口 IP，出口 IP 相同的节点只保留名称排序最靠前的一个。
+// 查询失败的节点原样保留
+func (st *SpeedTester) dedupByExitIP(proxies map[string]*CProxy) map[string]*CProxy {
+	names := make([]string, 0, len(proxies))
+	for name := range proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exitIPs := make(map[string]string, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, max(st.config.Concurrent, 8))
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			location, err := st.getIPLocation(proxies[name], st.config.Timeout+5*time.Second)
+			if err != nil || location.IP == "" {
+				log.Debugln("Failed to resolve exit IP of %s: %v", name, err)
+				return
+			}
+			mu.Lock()
+			exitIPs[name] = location.IP
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	deduped := make(map[string]*CProxy, len(proxies))
+	keepByIP := make(map[string]string)
+	renamed := make(map[string]string)
+	for _, name := range names {
+		p := proxies[name]
+		ip, ok := exitIPs[name]
+		if !ok {
+			deduped[name] = p
+			continue
+		}
+		if keepName, ok := keepByIP[ip]; ok {
+			mergeDuplicate(deduped[keepName], p, name)
+			renamed[name] = keepName
+			st.duplicateCount++
+			log.Debugln("Collapse proxy %s into %s, same exit IP %s", name, keepName, ip)
+			continue
+		}
+		keepByIP[ip] = name
+		deduped[name] = p
+	}
+	st.remapGroupMembers(renamed)
+	return deduped
+}
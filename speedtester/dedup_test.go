@@ -0,0 +1,33 @@
+package speedtester
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProxiesFilterBeforeDedup(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.yaml")
+	second := filepath.Join(dir, "b.yaml")
+	os.WriteFile(first, []byte("proxies:\n  - {name: blocked, type: http, server: 1.1.1.1, port: 443}\n"), 0o600)
+	os.WriteFile(second, []byte("proxies:\n  - {name: kept, type: http, server: 1.1.1.1, port: 443}\n"), 0o600)
+
+	tests := []struct {
+		config *Config
+		want   string
+	}{
+		{&Config{ConfigPaths: first + "," + second, BlockRegex: "blocked"}, "kept"},
+		{&Config{ConfigPaths: first + "," + second, FilterRegex: "kept"}, "kept"},
+		{&Config{ConfigPaths: first + "," + second, FilterExpr: `name != blocked && fingerprint != ""`}, "kept"},
+	}
+	for _, tt := range tests {
+		proxies, err := New(tt.config).LoadProxies(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := proxies[tt.want]; !ok || len(proxies) != 1 {
+			t.Errorf("%+v: got %d proxies, want only %s", tt.config, len(proxies), tt.want)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package speedtester
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/metacubex/mihomo/constant"
+)
+
+// testJitter 通过测速服务器的 /ws（download-server 提供的 WebSocket echo）在同一个连接上连续测量 PingCount 次往返延迟，
+// 计算平均延迟、抖动和丢包率。连接失败时返回 nil
+func (st *SpeedTester) testJitter(proxy constant.Proxy) *latencyResult {
+	wsURL, err := echoURL(st.config.ServerURL)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.MaxLatency+time.Duration(st.config.PingCount)*st.config.MaxLatency)
+	defer cancel()
+
+	dialer := ws.Dialer{
+		Timeout: st.config.MaxLatency,
+		NetDial: st.dialContext(proxy),
+	}
+	if st.config.ServerToken != "" {
+		dialer.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer " + st.config.ServerToken}})
+	}
+	conn, _, _, err := dialer.Dial(ctx, wsURL)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	var latencies []time.Duration
+	failed := 0
+	message := make([]byte, 8)
+	for i := range st.config.PingCount {
+		binary.BigEndian.PutUint64(message, uint64(i))
+		conn.SetDeadline(time.Now().Add(st.config.MaxLatency))
+		// 帧头和内容一次写入，分开写入会因 Nagle 算法增加延迟
+		frame, _ := ws.CompileFrame(ws.MaskFrame(ws.NewBinaryFrame(message)))
+		start := time.Now()
+		if _, err := conn.Write(frame); err != nil {
+			// 连接已断开，剩余的请求都计为丢失
+			failed += st.config.PingCount - i
+			break
+		}
+		reply, err := wsutil.ReadServerBinary(conn)
+		if err != nil {
+			failed += st.config.PingCount - i
+			break
+		}
+		if !bytes.Equal(reply, message) {
+			failed++
+			continue
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return calculateLatencyStats(latencies, failed)
+}
+
+// echoURL 将测速服务器地址转换为 WebSocket echo 地址
+func echoURL(serverURL string) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+	return u.String(), nil
+}
+
+// testUDP 通过节点向 UDPEcho（download-server 的 UDP echo 端口）发送 PingCount 个数据包，返回平均往返延迟和丢包率
+func (st *SpeedTester) testUDP(proxy constant.Proxy) (time.Duration, float64) {
+	count := max(st.config.PingCount, 1)
+	if !proxy.SupportUDP() {
+		return 0, 100
+	}
+	host, port, err := net.SplitHostPort(st.config.UDPEcho)
+	if err != nil {
+		return 0, 100
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		return 0, 100
+	}
+	addrPort := addr.AddrPort()
+	metadata := &constant.Metadata{
+		NetWork: constant.UDP,
+		DstIP:   addrPort.Addr().Unmap(),
+		DstPort: addrPort.Port(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.MaxLatency)
+	defer cancel()
+	rawPC, err := proxy.ListenPacketContext(ctx, metadata)
+	if err != nil {
+		return 0, 100
+	}
+	pc := st.meterPacket(proxy, rawPC)
+	defer pc.Close()
+
+	var latencies []time.Duration
+	message := make([]byte, 8)
+	buf := make([]byte, 64)
+	for i := range count {
+		binary.BigEndian.PutUint64(message, uint64(i))
+		start := time.Now()
+		if _, err := pc.WriteTo(message, metadata.UDPAddr()); err != nil {
+			continue
+		}
+		pc.SetReadDeadline(start.Add(st.config.MaxLatency))
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			// 忽略之前超时的数据包迟到的回复
+			if n == len(message) && bytes.Equal(buf[:n], message) {
+				latencies = append(latencies, time.Since(start))
+				break
+			}
+		}
+	}
+	stats := calculateLatencyStats(latencies, count-len(latencies))
+	return stats.avgLatency, stats.packetLoss
+}
@@ -0,0 +1,187 @@
+package speedtester
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/faceair/clash-speedtest/filter"
+)
+
+// nodeFields 测试前即可确定的节点属性，节点配置中的其他字段通过 config.<字段名> 读取
+var nodeFields = map[string]filter.Kind{
+	"name":        filter.String,
+	"type":        filter.String,
+	"server":      filter.String,
+	"port":        filter.Number,
+	"source":      filter.String,
+	"provider":    filter.String,
+	"fingerprint": filter.String,
+}
+
+// resultFields 测试后才有的结果字段
+var resultFields = map[string]filter.Kind{
+	"latency":          filter.Duration,
+	"jitter":           filter.Duration,
+	"packet_loss":      filter.Number,
+	"download":         filter.Speed,
+	"upload":           filter.Speed,
+	"country":          filter.String,
+	"udp_latency":      filter.Duration,
+	"udp_packet_loss":  filter.Number,
+	"stream_download":  filter.Speed,
+	"stream_upload":    filter.Speed,
+	"download_percent": filter.Number,
+	"upload_percent":   filter.Number,
+}
+
+// configFieldPrefix 是节点配置字段的前缀，如 config.network。要求显式前缀，避免拼错的字段名被当作配置字段而不报错
+const configFieldPrefix = "config."
+
+func filterSchema(field string) (filter.Kind, bool) {
+	if kind, ok := nodeFields[field]; ok {
+		return kind, true
+	}
+	if kind, ok := resultFields[field]; ok {
+		return kind, true
+	}
+	if key, ok := strings.CutPrefix(field, configFieldPrefix); ok && key != "" {
+		return filter.Any, true
+	}
+	return 0, false
+}
+
+func isResultField(field string) bool {
+	_, ok := resultFields[field]
+	return ok
+}
+
+// ParseFilter 解析筛选表达式，返回测试前按节点属性过滤的部分和测试后按结果过滤的部分
+func ParseFilter(expr string) (nodeFilter *filter.Expr, resultFilter *filter.Expr, err error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil, nil
+	}
+	parsed, err := filter.Parse(expr, filterSchema)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid filter expression: %w", err)
+	}
+	nodeFilter, resultFilter = parsed.Split(isResultField)
+	return nodeFilter, resultFilter, nil
+}
+
+// proxyEnv 为筛选表达式提供节点属性
+type proxyEnv struct {
+	name  string
+	proxy *CProxy
+}
+
+func (e proxyEnv) Lookup(field string) (any, bool) {
+	switch field {
+	case "name":
+		return e.name, true
+	case "type":
+		return e.proxy.Type().String(), true
+	case "server", "port":
+		return nodeConfigValue(e.proxy.Config, field)
+	case "source":
+		return RedactSource(e.proxy.Source), true
+	case "provider":
+		return e.proxy.Provider, true
+	case "fingerprint":
+		return e.proxy.Fingerprint, true
+	}
+	return configValue(e.proxy.Config, field)
+}
+
+// resultEnv 为筛选表达式提供节点属性和测试结果
+type resultEnv struct {
+	result *Result
+}
+
+func (e resultEnv) Lookup(field string) (any, bool) {
+	r := e.result
+	switch field {
+	case "name":
+		return r.ProxyName, true
+	case "type":
+		return r.ProxyType, true
+	case "server", "port":
+		return nodeConfigValue(r.ProxyConfig, field)
+	case "source":
+		return RedactSource(r.Source), true
+	case "provider":
+		return r.Provider, true
+	case "fingerprint":
+		return r.Fingerprint, true
+	case "latency":
+		return r.Latency, true
+	case "jitter":
+		return r.Jitter, true
+	case "packet_loss":
+		return r.PacketLoss, true
+	case "download":
+		return r.DownloadSpeed, true
+	case "upload":
+		return r.UploadSpeed, true
+	case "country":
+		return r.Country, r.Country != ""
+	case "udp_latency":
+		return r.UDPLatency, r.UDPLatency > 0
+	case "udp_packet_loss":
+		return r.UDPPacketLoss, r.UDPLatency > 0 || r.UDPPacketLoss > 0
+	case "stream_download":
+		return r.StreamDownloadSpeed, r.StreamDownloadSpeed > 0
+	case "stream_upload":
+		return r.StreamUploadSpeed, r.StreamUploadSpeed > 0
+	case "download_percent":
+		return r.DownloadPercent, r.DownloadPercent > 0
+	case "upload_percent":
+		return r.UploadPercent, r.UploadPercent > 0
+	}
+	return configValue(r.ProxyConfig, field)
+}
+
+// nodeConfigValue 读取节点配置中的 server 或 port，字符串形式的端口转为数字
+func nodeConfigValue(config map[string]any, field string) (any, bool) {
+	v, ok := configValue(config, configFieldPrefix+field)
+	if s, isString := v.(string); ok && isString && field == "port" {
+		port, err := strconv.ParseFloat(s, 64)
+		return port, err == nil
+	}
+	return v, ok
+}
+
+// configValue 从节点配置中读取 config.<字段名>，数字统一为 float64，其余转为字符串
+func configValue(config map[string]any, field string) (any, bool) {
+	key, ok := strings.CutPrefix(field, configFieldPrefix)
+	if !ok {
+		return nil, false
+	}
+	v, ok := config[key]
+	if !ok || v == nil {
+		return nil, false
+	}
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return fmt.Sprint(v), true
+}
+
+// MatchResult 判断结果是否满足筛选表达式中依赖测试结果的部分
+func (st *SpeedTester) MatchResult(result *Result) bool {
+	return st.resultFilter.Match(resultEnv{result: result})
+}
+
+// needCountry 表示筛选表达式或国家筛选需要节点的出口国家
+func (st *SpeedTester) needCountry() bool {
+	return st.config.Countries != "" || st.config.ExcludeCountries != "" || st.config.TopPerCountry > 0 ||
+		slices.Contains(st.resultFilter.Fields(), "country")
+}
@@ -0,0 +1,70 @@
+package speedtester
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.SILENT)
+	os.Exit(m.Run())
+}
+
+const filterTestConfig = `proxies:
+  - {name: a, type: http, server: 1.1.1.1, port: 443}
+  - {name: b, type: http, server: 8.8.8.8, port: "8080"}
+  - {name: c, type: socks5, server: 9.9.9.9, port: 1080}
+`
+
+// loadFiltered 用 expr 加载 filterTestConfig，返回保留的节点名
+func loadFiltered(t *testing.T, expr string) []string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(filterTestConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	st := New(&Config{ConfigPaths: path, FilterExpr: expr})
+	proxies, err := st.LoadProxies(false)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(proxies))
+	for name := range proxies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestLoadProxiesNodeFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"port == 443", []string{"a"}},
+		{"port != 443", []string{"b", "c"}},
+		{"port >= 443", []string{"a", "b", "c"}},
+		{`server == "1.1.1.1"`, []string{"a"}},
+		{"server in (8.8.8.8, 9.9.9.9) && type == socks5", []string{"c"}},
+		{"config.port == 443", []string{"a"}},
+	}
+	for _, tt := range tests {
+		if got := loadFiltered(t, tt.expr); !slices.Equal(got, tt.want) {
+			t.Errorf("%q = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestResultEnvNodeFields(t *testing.T) {
+	env := resultEnv{result: &Result{ProxyConfig: map[string]any{"server": "1.1.1.1", "port": 443}}}
+	if v, ok := env.Lookup("port"); !ok || v != float64(443) {
+		t.Errorf("port = %v, %v", v, ok)
+	}
+	if v, ok := env.Lookup("server"); !ok || v != "1.1.1.1" {
+		t.Errorf("server = %v, %v", v, ok)
+	}
+}
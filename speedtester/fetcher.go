@@ -0,0 +1,291 @@
+package speedtester
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/metacubex/mihomo/log"
+)
+
+const (
+	defaultUserAgent    = "clash.meta"
+	defaultFetchTimeout = 30 * time.Second
+	maxSubscriptionSize = 64 * 1024 * 1024
+)
+
+// errRemoteSkipped 表示离线模式下远程来源没有可用的缓存
+var errRemoteSkipped = errors.New("remote source skipped: no network access in lint and no cache")
+
+// fetchResult 表示一次订阅下载的结果
+type fetchResult struct {
+	body   []byte
+	header http.Header
+	cached bool // 内容来自本地缓存（304 或下载失败）
+}
+
+// fetchCacheMeta 是缓存在磁盘上的响应元信息
+type fetchCacheMeta struct {
+	URL          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	FetchedAt    time.Time   `json:"fetched_at"`
+}
+
+// fetcher 下载订阅和 provider，支持自定义请求头、重试、条件请求缓存和经代理下载
+type fetcher struct {
+	client    *http.Client
+	userAgent string
+	headers   http.Header
+	retries   int
+	cacheDir  string
+	offline   bool // 只读取磁盘缓存，不发起请求
+}
+
+func newFetcher(config *Config) (*fetcher, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.FetchProxy != "" {
+		proxyURL, err := url.Parse(config.FetchProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fetch proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	timeout := config.FetchTimeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	if config.CacheDir != "" {
+		// 缓存中是完整的订阅内容，包括节点凭据，只允许当前用户访问
+		if err := os.MkdirAll(config.CacheDir, 0o700); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+		if err := os.Chmod(config.CacheDir, 0o700); err != nil {
+			return nil, fmt.Errorf("create cache dir: %w", err)
+		}
+	}
+
+	return &fetcher{
+		client:    &http.Client{Transport: transport, Timeout: timeout},
+		userAgent: userAgent,
+		headers:   config.FetchHeaders,
+		retries:   max(config.FetchRetries, 0),
+		cacheDir:  config.CacheDir,
+	}, nil
+}
+
+// fetch 下载 rawURL，header 中的请求头优先于全局配置。
+// 失败时按指数退避重试，全部失败后使用磁盘缓存（如果有）
+// offline 时只使用磁盘缓存，没有缓存时返回 errRemoteSkipped
+func (f *fetcher) fetch(rawURL string, header map[string][]string) (*fetchResult, error) {
+	meta, cachedBody := f.loadCache(rawURL)
+	if f.offline {
+		if cachedBody == nil {
+			return nil, errRemoteSkipped
+		}
+		return &fetchResult{body: decodeSubscription(cachedBody), header: meta.Header, cached: true}, nil
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= f.retries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<(attempt-1)) * time.Second
+			log.Debugln("Retry fetching %s in %s: %v", rawURL, backoff, lastErr)
+			time.Sleep(backoff)
+		}
+
+		result, retry, err := f.fetchOnce(rawURL, header, meta, cachedBody)
+		if err == nil {
+			return result, nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+
+	if cachedBody != nil {
+		log.Warnln("Failed to fetch %s, use cache from %s: %v", rawURL, meta.FetchedAt.Format(time.DateTime), lastErr)
+		return &fetchResult{body: decodeSubscription(cachedBody), header: meta.Header, cached: true}, nil
+	}
+	return nil, lastErr
+}
+
+// fetchOnce 发起一次请求，retry 表示错误是否值得重试
+func (f *fetcher) fetchOnce(rawURL string, header map[string][]string, meta *fetchCacheMeta, cachedBody []byte) (result *fetchResult, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	for k, values := range f.headers {
+		req.Header[http.CanonicalHeaderKey(k)] = values
+	}
+	for k, values := range header {
+		req.Header[http.CanonicalHeaderKey(k)] = values
+	}
+	if cachedBody != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cachedBody != nil:
+		log.Debugln("Subscription %s not modified, use cache", rawURL)
+		// 304 响应中的头（如 subscription-userinfo 的流量和到期时间）会更新，按 RFC 9111 合并到缓存的响应头中
+		header := meta.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		for k, values := range resp.Header {
+			if k != "Content-Length" {
+				header[k] = values
+			}
+		}
+		f.saveCacheMeta(rawURL, header)
+		return &fetchResult{body: decodeSubscription(cachedBody), header: header, cached: true}, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("unexpected status %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSubscriptionSize+1))
+	if err != nil {
+		return nil, true, err
+	}
+	if len(body) > maxSubscriptionSize {
+		return nil, false, fmt.Errorf("subscription larger than %d bytes", maxSubscriptionSize)
+	}
+
+	f.saveCache(rawURL, resp.Header, body)
+	return &fetchResult{body: decodeSubscription(body), header: resp.Header}, false, nil
+}
+
+// cachePath 返回 rawURL 对应的缓存文件路径（不含扩展名）
+func (f *fetcher) cachePath(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return filepath.Join(f.cacheDir, hex.EncodeToString(sum[:8]))
+}
+
+func (f *fetcher) loadCache(rawURL string) (*fetchCacheMeta, []byte) {
+	if f.cacheDir == "" {
+		return nil, nil
+	}
+	path := f.cachePath(rawURL)
+	metaBytes, err := os.ReadFile(path + ".json")
+	if err != nil {
+		return nil, nil
+	}
+	meta := &fetchCacheMeta{}
+	if err := json.Unmarshal(metaBytes, meta); err != nil || meta.URL != rawURL {
+		return nil, nil
+	}
+	body, err := os.ReadFile(path + ".body")
+	if err != nil {
+		return nil, nil
+	}
+	return meta, body
+}
+
+func (f *fetcher) saveCache(rawURL string, header http.Header, body []byte) {
+	if f.cacheDir == "" {
+		return
+	}
+	if err := writePrivateFile(f.cachePath(rawURL)+".body", body); err != nil {
+		log.Warnln("Failed to write cache for %s: %v", rawURL, err)
+		return
+	}
+	f.saveCacheMeta(rawURL, header)
+}
+
+// saveCacheMeta 写入缓存的响应元信息，304 时只更新元信息
+func (f *fetcher) saveCacheMeta(rawURL string, header http.Header) {
+	if f.cacheDir == "" {
+		return
+	}
+	meta := &fetchCacheMeta{
+		URL:          rawURL,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		Header:       header,
+		FetchedAt:    time.Now(),
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	if err := writePrivateFile(f.cachePath(rawURL)+".json", metaBytes); err != nil {
+		log.Warnln("Failed to write cache for %s: %v", rawURL, err)
+	}
+}
+
+// writePrivateFile 写入只有当前用户可以读写的文件，已存在的文件同样修正权限
+func writePrivateFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0o600)
+}
+
+// decodeSubscription 识别并还原订阅内容：去掉 UTF-8 BOM，解压 gzip，解码整体 base64 编码的内容
+func decodeSubscription(body []byte) []byte {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		if reader, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decompressed, err := io.ReadAll(io.LimitReader(reader, maxSubscriptionSize)); err == nil {
+				body = bytes.TrimPrefix(decompressed, []byte("\xef\xbb\xbf"))
+			}
+		}
+	}
+
+	if decoded, ok := decodeBase64(body); ok {
+		body = bytes.TrimPrefix(decoded, []byte("\xef\xbb\xbf"))
+	}
+	return body
+}
+
+// decodeBase64 尝试将整段内容作为 base64 解码，YAML 和链接列表包含 base64 字母表以外的字符，不会被误判
+func decodeBase64(body []byte) ([]byte, bool) {
+	s := strings.Join(strings.Fields(string(body)), "")
+	if s == "" {
+		return nil, false
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, err := encoding.DecodeString(s)
+		if err == nil && utf8.Valid(decoded) {
+			return decoded, true
+		}
+	}
+	return nil, false
+}
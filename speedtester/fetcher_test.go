@@ -0,0 +1,48 @@
+package speedtester
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetchNotModifiedRefreshesHeader(t *testing.T) {
+	userInfo := "upload=1; download=2; total=100"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Subscription-Userinfo", userInfo)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/yaml")
+		w.Write([]byte("proxies: []\n"))
+	}))
+	defer server.Close()
+
+	f, err := newFetcher(&Config{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.fetch(server.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	userInfo = "upload=10; download=20; total=100"
+	result, err := f.fetch(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.cached || string(result.body) != "proxies: []\n" {
+		t.Errorf("want cached body, got cached=%v body=%q", result.cached, result.body)
+	}
+	if got := result.header.Get("Subscription-Userinfo"); got != userInfo {
+		t.Errorf("header = %q, want %q", got, userInfo)
+	}
+	if got := result.header.Get("Content-Type"); got != "text/yaml" {
+		t.Errorf("cached header lost: Content-Type = %q", got)
+	}
+	if meta, _ := f.loadCache(server.URL); meta == nil || meta.Header.Get("Subscription-Userinfo") != userInfo || meta.ETag != `"v1"` {
+		t.Errorf("cache metadata not refreshed: %+v", meta)
+	}
+}
@@ -0,0 +1,90 @@
+package speedtester
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fingerprintIgnoredKeys 不影响节点实际连接目标和协议的配置项，不参与指纹计算
+var fingerprintIgnoredKeys = map[string]bool{
+	"name":           true,
+	"udp":            true,
+	"tfo":            true,
+	"mptcp":          true,
+	"interface-name": true,
+	"routing-mark":   true,
+	"ip-version":     true,
+	"smux":           true,
+}
+
+// Fingerprint 根据节点的类型、服务器、端口、凭据和传输层选项计算稳定的指纹，
+// 与节点名称和配置项顺序无关
+func Fingerprint(config map[string]any) string {
+	keys := make([]string, 0, len(config))
+	for k := range config {
+		if !fingerprintIgnoredKeys[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		writeCanonical(&b, k, config[k])
+		b.WriteByte(';')
+	}
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// writeCanonical 以规范形式写入配置值：map 按 key 排序，端口统一为数字，类型和服务器统一为小写
+func writeCanonical(b *strings.Builder, key string, value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteByte('{')
+		for _, k := range keys {
+			b.WriteString(k)
+			b.WriteByte(':')
+			writeCanonical(b, k, v[k])
+			b.WriteByte(',')
+		}
+		b.WriteByte('}')
+	case []any:
+		b.WriteByte('[')
+		for _, item := range v {
+			writeCanonical(b, key, item)
+			b.WriteByte(',')
+		}
+		b.WriteByte(']')
+	case string:
+		switch key {
+		case "type", "server":
+			v = strings.ToLower(strings.TrimSpace(v))
+		case "port":
+			if port, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				v = strconv.Itoa(port)
+			}
+		}
+		b.WriteString(strconv.Quote(v))
+	case int, int64, uint16, float64:
+		if key == "port" {
+			b.WriteString(strconv.Quote(fmt.Sprint(v)))
+			return
+		}
+		fmt.Fprint(b, v)
+	default:
+		fmt.Fprint(b, v)
+	}
+}
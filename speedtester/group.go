@@ -0,0 +1,480 @@
+package speedtester
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dlclark/regexp2"
+	"github.com/metacubex/mihomo/log"
+)
+
+// 策略组类型，与 mihomo 一致
+const (
+	GroupSelect      = "select"
+	GroupURLTest     = "url-test"
+	GroupFallback    = "fallback"
+	GroupLoadBalance = "load-balance"
+	GroupRelay       = "relay"
+)
+
+// ProxyGroup 表示配置中的一个策略组，成员已展开嵌套策略组和 provider
+type ProxyGroup struct {
+	Name    string
+	Type    string
+	Source  string
+	Config  map[string]any // 原始配置，用于输出
+	Members []string       // 展开后的节点名（LoadProxies 返回的 key），保持配置中的顺序
+	Total   int            // 声明的节点总数，包括被过滤或不支持的节点
+	Entries []GroupEntry   // 未展开的直接成员，用于输出时保留对其他策略组的引用
+}
+
+// GroupEntry 表示策略组的一个直接成员
+type GroupEntry struct {
+	Name string // 节点名（LoadProxies 返回的 key），或 Ref 为 true 时的策略组名或内置策略
+	Ref  bool   // Name 是同一来源中的策略组或 DIRECT、REJECT 等内置策略
+}
+
+// GroupReport 表示策略组的测试结果
+type GroupReport struct {
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Source   string        `json:"source"`
+	Total    int           `json:"total"`
+	Tested   int           `json:"tested"`
+	Alive    int           `json:"alive"`
+	Coverage float64       `json:"coverage"` // 已测试节点占比（百分比）
+	Selected string        `json:"selected"` // 按策略组语义选中的节点
+	Latency  time.Duration `json:"latency"`  // 选中节点的延迟
+}
+
+// groupMember 表示解析过程中的策略组成员节点
+type groupMember struct {
+	name  string // 节点在配置中的原始名称
+	proxy *CProxy
+}
+
+// groupSource 表示单个配置来源中可被策略组引用的节点
+type groupSource struct {
+	path      string
+	proxies   []groupMember            // 按配置顺序的 proxies
+	providers map[string][]groupMember // provider 名 -> 节点
+}
+
+// Groups 返回最近一次 LoadProxies 加载的策略组
+func (st *SpeedTester) Groups() []*ProxyGroup {
+	return st.groups
+}
+
+// resolveGroups 展开来源中的所有策略组，finalNames 为节点到最终名称的映射，未出现的节点视为已被过滤
+func resolveGroups(src *groupSource, groupsConfig []map[string]any, finalNames map[*CProxy]string) []*ProxyGroup {
+	configs := make(map[string]map[string]any, len(groupsConfig))
+	for _, config := range groupsConfig {
+		if name, ok := config["name"].(string); ok {
+			configs[name] = config
+		}
+	}
+
+	var groups []*ProxyGroup
+	for _, config := range groupsConfig {
+		name, _ := config["name"].(string)
+		groupType, _ := config["type"].(string)
+		if name == "" {
+			continue
+		}
+
+		members := expandGroup(src, configs, name, map[string]bool{})
+		group := &ProxyGroup{
+			Name:    name,
+			Type:    groupType,
+			Source:  src.path,
+			Config:  config,
+			Total:   len(members),
+			Entries: groupEntries(src, configs, name, finalNames),
+		}
+		for _, m := range members {
+			if finalName, ok := finalNames[m.proxy]; ok && !slices.Contains(group.Members, finalName) {
+				group.Members = append(group.Members, finalName)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// expandGroup 递归展开策略组成员，visiting 用于检测循环引用
+func expandGroup(src *groupSource, configs map[string]map[string]any, name string, visiting map[string]bool) []groupMember {
+	if visiting[name] {
+		log.Warnln("Proxy group %s in %s has a circular reference", name, src.path)
+		return nil
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	config := configs[name]
+	var members []groupMember
+	seen := make(map[*CProxy]bool)
+	add := func(m groupMember) {
+		if !seen[m.proxy] {
+			seen[m.proxy] = true
+			members = append(members, m)
+		}
+	}
+
+	// proxies 中显式列出的节点或策略组
+	for _, ref := range toStringSlice(config["proxies"]) {
+		if _, ok := configs[ref]; ok {
+			for _, m := range expandGroup(src, configs, ref, visiting) {
+				add(m)
+			}
+			continue
+		}
+		found := false
+		for _, m := range src.proxies {
+			if m.name == ref {
+				add(m)
+				found = true
+				break
+			}
+		}
+		if !found && !isBuiltinPolicy(ref) {
+			log.Debugln("Proxy group %s references unknown proxy %s", name, ref)
+		}
+	}
+
+	for _, m := range groupCandidates(src, config) {
+		add(m)
+	}
+	return members
+}
+
+// groupEntries 返回策略组的直接成员：proxies 中的策略组和内置策略保留引用，
+// 节点以及 use、include-all 引入的节点使用最终名称，已被过滤的节点不包括在内
+func groupEntries(src *groupSource, configs map[string]map[string]any, name string, finalNames map[*CProxy]string) []GroupEntry {
+	config := configs[name]
+	var entries []GroupEntry
+	add := func(entry GroupEntry) {
+		if !slices.Contains(entries, entry) {
+			entries = append(entries, entry)
+		}
+	}
+	addMember := func(m groupMember) {
+		if finalName, ok := finalNames[m.proxy]; ok {
+			add(GroupEntry{Name: finalName})
+		}
+	}
+
+	for _, ref := range toStringSlice(config["proxies"]) {
+		if _, ok := configs[ref]; ok {
+			add(GroupEntry{Name: ref, Ref: true})
+			continue
+		}
+		if i := slices.IndexFunc(src.proxies, func(m groupMember) bool { return m.name == ref }); i >= 0 {
+			addMember(src.proxies[i])
+			continue
+		}
+		if isBuiltinPolicy(ref) {
+			add(GroupEntry{Name: ref, Ref: true})
+		}
+	}
+	for _, m := range groupCandidates(src, config) {
+		addMember(m)
+	}
+	return entries
+}
+
+// groupCandidates 返回 use 引用的 provider 以及 include-all 引入的节点中满足 exclude-type、filter、exclude-filter 的节点。
+// exclude-type 匹配节点类型（如 Shadowsocks）或配置中的 type（如 ss），不区分大小写
+func groupCandidates(src *groupSource, config map[string]any) []groupMember {
+	var candidates []groupMember
+	for _, providerName := range toStringSlice(config["use"]) {
+		candidates = append(candidates, src.providers[providerName]...)
+	}
+	if isTrue(config["include-all"]) || isTrue(config["include-all-proxies"]) {
+		candidates = append(candidates, src.proxies...)
+	}
+	if isTrue(config["include-all"]) || isTrue(config["include-all-providers"]) {
+		providerNames := make([]string, 0, len(src.providers))
+		for providerName := range src.providers {
+			providerNames = append(providerNames, providerName)
+		}
+		sort.Strings(providerNames)
+		for _, providerName := range providerNames {
+			candidates = append(candidates, src.providers[providerName]...)
+		}
+	}
+
+	filter, _ := config["filter"].(string)
+	excludeFilter, _ := config["exclude-filter"].(string)
+	var excludeTypes []string
+	if excludeType, _ := config["exclude-type"].(string); excludeType != "" {
+		excludeTypes = strings.Split(excludeType, "|")
+	}
+	var matched []groupMember
+	for _, m := range candidates {
+		if m.proxy != nil && (excluded(excludeTypes, m.proxy.Type().String()) || excluded(excludeTypes, fmt.Sprint(m.proxy.Config["type"]))) {
+			continue
+		}
+		if filter != "" && !matchGroupFilter(filter, m.name) {
+			continue
+		}
+		if excludeFilter != "" && matchGroupFilter(excludeFilter, m.name) {
+			continue
+		}
+		matched = append(matched, m)
+	}
+	return matched
+}
+
+// isBuiltinPolicy 判断 name 是否为 mihomo 的内置策略
+func isBuiltinPolicy(name string) bool {
+	switch strings.ToUpper(name) {
+	case "DIRECT", "REJECT", "REJECT-DROP", "PASS", "COMPATIBLE":
+		return true
+	}
+	return false
+}
+
+// matchGroupFilter 按 mihomo 的规则匹配 filter：多个表达式用 ` 分隔，任一匹配即可
+func matchGroupFilter(filter string, name string) bool {
+	for _, expr := range strings.Split(filter, "`") {
+		re, err := regexp2.Compile(expr, regexp2.None)
+		if err != nil {
+			log.Warnln("Invalid proxy group filter %s: %v", expr, err)
+			continue
+		}
+		if ok, _ := re.MatchString(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filterByGroups 只保留属于指定策略组（名称以逗号分隔）的节点
+func (st *SpeedTester) filterByGroups(proxies map[string]*CProxy, groupNames string) (map[string]*CProxy, error) {
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(groupNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			wanted[name] = true
+		}
+	}
+
+	filtered := make(map[string]*CProxy)
+	matchedGroups := make(map[string]bool)
+	for _, group := range st.groups {
+		if !wanted[group.Name] {
+			continue
+		}
+		matchedGroups[group.Name] = true
+		for _, member := range group.Members {
+			if p, ok := proxies[member]; ok {
+				filtered[member] = p
+			}
+		}
+	}
+	for name := range wanted {
+		if !matchedGroups[name] {
+			return nil, fmt.Errorf("proxy group %s not found", name)
+		}
+	}
+	return filtered, nil
+}
+
+// remapGroupMembers 将被合并的节点名替换为保留的节点名
+func (st *SpeedTester) remapGroupMembers(renamed map[string]string) {
+	for _, group := range st.groups {
+		members := make([]string, 0, len(group.Members))
+		for _, member := range group.Members {
+			if keep, ok := renamed[member]; ok {
+				member = keep
+			}
+			if !slices.Contains(members, member) {
+				members = append(members, member)
+			}
+		}
+		group.Members = members
+
+		entries := make([]GroupEntry, 0, len(group.Entries))
+		for _, entry := range group.Entries {
+			if keep, ok := renamed[entry.Name]; ok && !entry.Ref {
+				entry.Name = keep
+			}
+			if !slices.Contains(entries, entry) {
+				entries = append(entries, entry)
+			}
+		}
+		group.Entries = entries
+	}
+}
+
+// ReportGroups 根据测试结果计算每个策略组的覆盖率、可用数和按策略组语义选中的节点
+func (st *SpeedTester) ReportGroups(results []*Result) []*GroupReport {
+	resultByName := make(map[string]*Result, len(results))
+	for _, result := range results {
+		resultByName[result.ProxyName] = result
+	}
+
+	reports := make([]*GroupReport, 0, len(st.groups))
+	for _, group := range st.groups {
+		report := &GroupReport{
+			Name:   group.Name,
+			Type:   group.Type,
+			Source: group.Source,
+			Total:  group.Total,
+		}
+
+		var alive []*Result
+		for _, member := range group.Members {
+			result, ok := resultByName[member]
+			if !ok {
+				continue
+			}
+			report.Tested++
+			if result.Latency > 0 {
+				alive = append(alive, result)
+			}
+		}
+		report.Alive = len(alive)
+		if report.Total > 0 {
+			report.Coverage = float64(report.Tested) / float64(report.Total) * 100
+		}
+
+		if selected := selectGroupMember(group, alive, resultByName); selected != nil {
+			report.Selected = selected.ProxyName
+			report.Latency = selected.Latency
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// selectGroupMember 模拟 mihomo 的选择逻辑：
+// url-test 选延迟最低的可用节点，fallback 选第一个可用节点，
+// load-balance 在可用节点间分流（此处报告延迟最低的一个），relay 报告整条链路，select 默认使用第一个成员
+func selectGroupMember(group *ProxyGroup, alive []*Result, resultByName map[string]*Result) *Result {
+	switch group.Type {
+	case GroupURLTest, GroupLoadBalance:
+		var best *Result
+		for _, r := range alive {
+			if best == nil || r.Latency < best.Latency {
+				best = r
+			}
+		}
+		return best
+	case GroupFallback:
+		if len(alive) > 0 {
+			return alive[0]
+		}
+		return nil
+	case GroupRelay:
+		return resultByName[group.Name]
+	default:
+		if len(group.Members) > 0 {
+			return resultByName[group.Members[0]]
+		}
+		return nil
+	}
+}
+
+func toStringSlice(v any) []string {
+	items, ok := v.([]any)
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func isTrue(v any) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// BuildProxyGroups 生成只包含 results 中节点的策略组配置，用于输出。
+// 对其他策略组和内置策略的引用原样保留，provider 和 include-all 引入的节点展开为节点列表（输出中没有 provider），
+// 没有剩余成员的策略组以及对它们的引用会被省略。relay 策略组不输出
+func BuildProxyGroups(groups []*ProxyGroup, results []*Result) []map[string]any {
+	outputNames := make(map[string]string, len(results))
+	for _, result := range results {
+		if name, ok := result.ProxyConfig["name"].(string); ok {
+			outputNames[result.ProxyName] = name
+		}
+	}
+
+	type groupKey struct{ source, name string }
+	bySource := make(map[groupKey]*ProxyGroup, len(groups))
+	for _, group := range groups {
+		if _, ok := bySource[groupKey{group.Source, group.Name}]; !ok {
+			bySource[groupKey{group.Source, group.Name}] = group
+		}
+	}
+
+	// members 计算策略组输出的成员，visiting 用于避免循环引用
+	resolved := make(map[*ProxyGroup][]string)
+	visiting := make(map[*ProxyGroup]bool)
+	var members func(group *ProxyGroup) []string
+	members = func(group *ProxyGroup) []string {
+		if result, ok := resolved[group]; ok {
+			return result
+		}
+		if visiting[group] || group.Type == GroupRelay {
+			return nil
+		}
+		visiting[group] = true
+		defer delete(visiting, group)
+
+		var result []string
+		for _, entry := range group.Entries {
+			name := entry.Name
+			switch ref, ok := bySource[groupKey{group.Source, entry.Name}]; {
+			case entry.Ref && ok:
+				if len(members(ref)) == 0 {
+					continue
+				}
+			case entry.Ref:
+			default:
+				if name, ok = outputNames[entry.Name]; !ok {
+					continue
+				}
+			}
+			if !slices.Contains(result, name) {
+				result = append(result, name)
+			}
+		}
+		resolved[group] = result
+		return result
+	}
+
+	var output []map[string]any
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		if seen[group.Name] {
+			continue
+		}
+		proxies := members(group)
+		if len(proxies) == 0 {
+			continue
+		}
+		seen[group.Name] = true
+
+		config := make(map[string]any, len(group.Config))
+		for k, v := range group.Config {
+			switch k {
+			case "proxies", "use", "filter", "exclude-filter", "exclude-type",
+				"include-all", "include-all-proxies", "include-all-providers":
+			default:
+				config[k] = v
+			}
+		}
+		config["proxies"] = proxies
+		output = append(output, config)
+	}
+	return output
+}
@@ -0,0 +1,59 @@
+package speedtester
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const groupTestConfig = `proxies:
+  - {name: a, type: http, server: 1.1.1.1, port: 443}
+  - {name: b, type: socks5, server: 2.2.2.2, port: 1080}
+proxy-providers:
+  p:
+    type: inline
+    payload:
+      - {name: HK c, type: socks5, server: 3.3.3.3, port: 1080}
+      - {name: HK d, type: http, server: 4.4.4.4, port: 80}
+proxy-groups:
+  - {name: All, type: select, include-all: true, exclude-type: Socks5}
+  - {name: HK, type: url-test, use: [p], filter: HK, exclude-type: "socks5|vmess"}
+  - {name: Main, type: select, proxies: [HK, Empty, DIRECT, b]}
+  - {name: Empty, type: select, proxies: [missing]}
+`
+
+func TestBuildProxyGroups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(groupTestConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	st := New(&Config{ConfigPaths: path})
+	proxies, err := st.LoadProxies(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []*Result
+	for name, p := range proxies {
+		results = append(results, &Result{ProxyName: name, ProxyConfig: p.Config})
+	}
+
+	want := map[string][]string{
+		"All":  {"a", "HK d"},
+		"HK":   {"HK d"},
+		"Main": {"HK", "DIRECT", "b"},
+	}
+	groups := BuildProxyGroups(st.Groups(), results)
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d", len(groups), len(want))
+	}
+	for _, group := range groups {
+		name := group["name"].(string)
+		if got := group["proxies"].([]string); !slices.Equal(got, want[name]) {
+			t.Errorf("group %s proxies = %v, want %v", name, got, want[name])
+		}
+		if _, ok := group["exclude-type"]; ok {
+			t.Errorf("group %s still has exclude-type", name)
+		}
+	}
+}
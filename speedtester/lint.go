@@ -0,0 +1,159 @@
+package speedtester
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 检查结果的严重程度
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintIssue 表示静态检查发现的一个问题
+type LintIssue struct {
+	Level    string `json:"level"`
+	Source   string `json:"source"`             // 配置来源，已去掉凭据和查询参数
+	Provider string `json:"provider,omitempty"` // provider 名称，配置中直接定义的节点为空
+	Index    int    `json:"index"`              // 节点在来源中的原始位置，与节点无关的问题为 -1
+	Name     string `json:"name,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Lint 只解析配置来源并检查节点配置，不连接任何节点，也不解析域名。
+// 不会发起任何网络请求：远程订阅和 HTTP provider 只读取磁盘缓存（-cache-dir）或 provider 的 path，
+// 都没有时作为警告跳过
+func (st *SpeedTester) Lint(stashCompatible bool) []*LintIssue {
+	st.linting = true
+	defer func() { st.linting = false }()
+
+	if _, err := st.LoadProxies(stashCompatible); err != nil {
+		st.addIssue(LintError, st.config.ConfigPaths, "", -1, "", "%v", err)
+	}
+
+	// 按来源出现的顺序和节点位置排序
+	order := make(map[sourceKey]int)
+	for _, issue := range st.issues {
+		key := sourceKey{source: issue.Source, provider: issue.Provider}
+		if _, ok := order[key]; !ok {
+			order[key] = len(order)
+		}
+	}
+	sort.SliceStable(st.issues, func(i, j int) bool {
+		a, b := st.issues[i], st.issues[j]
+		ka, kb := order[sourceKey{a.Source, a.Provider}], order[sourceKey{b.Source, b.Provider}]
+		if ka != kb {
+			return ka < kb
+		}
+		return a.Index < b.Index
+	})
+	return st.issues
+}
+
+// addIssue 记录一个问题，LoadProxies 在跳过节点或来源时调用
+func (st *SpeedTester) addIssue(level string, source string, provider string, index int, name string, format string, args ...any) {
+	st.issues = append(st.issues, &LintIssue{
+		Level:    level,
+		Source:   RedactSource(source),
+		Provider: provider,
+		Index:    index,
+		Name:     name,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (st *SpeedTester) addProxyIssue(level string, p *CProxy, name string, format string, args ...any) {
+	st.addIssue(level, p.Source, p.Provider, p.Index, name, format, args...)
+}
+
+// requiredFields 各协议必须设置的字段
+var requiredFields = map[string][]string{
+	"ss":        {"cipher", "password"},
+	"ssr":       {"cipher", "password", "protocol", "obfs"},
+	"vmess":     {"uuid"},
+	"vless":     {"uuid"},
+	"trojan":    {"password"},
+	"hysteria":  {"auth-str|auth"},
+	"hysteria2": {"password"},
+	"tuic":      {"uuid|token"},
+	"snell":     {"psk"},
+	"anytls":    {"password"},
+	"mieru":     {"username", "password"},
+	"wireguard": {"private-key"},
+	"ssh":       {"username"},
+}
+
+// lintProxy 静态检查单个节点的服务器地址、端口和必填字段
+func (st *SpeedTester) lintProxy(name string, p *CProxy) {
+	config := p.Config
+	proxyType, _ := config["type"].(string)
+
+	server, _ := config["server"].(string)
+	switch host := strings.TrimSpace(server); {
+	case host == "" && proxyType != "wireguard":
+		st.addProxyIssue(LintError, p, name, "missing server")
+	case host != "":
+		if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+			if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+				st.addProxyIssue(LintWarning, p, name, "server %s is a private or loopback address", host)
+			}
+		} else if !isValidHostname(host) {
+			st.addProxyIssue(LintError, p, name, "server %q is not a valid hostname", host)
+		} else if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") {
+			st.addProxyIssue(LintWarning, p, name, "server %s is a local hostname", host)
+		}
+	}
+
+	// hysteria 系列可以只设置端口跳跃的 ports，wireguard 的 peers 中也可以各自设置
+	if port, ok := config["port"]; ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(fmt.Sprint(port))); err != nil || n < 1 || n > 65535 {
+			st.addProxyIssue(LintError, p, name, "invalid port %v", port)
+		}
+	} else if !hasAnyField(config, []string{"ports", "peers"}) {
+		st.addProxyIssue(LintError, p, name, "missing port")
+	}
+
+	for _, field := range requiredFields[proxyType] {
+		if !hasAnyField(config, strings.Split(field, "|")) {
+			st.addProxyIssue(LintError, p, name, "missing required field %s", strings.ReplaceAll(field, "|", " or "))
+		}
+	}
+
+	if reality, ok := config["reality-opts"].(map[string]any); ok {
+		if !hasAnyField(reality, []string{"public-key"}) {
+			st.addProxyIssue(LintError, p, name, "missing required field reality-opts.public-key")
+		}
+	}
+}
+
+func hasAnyField(config map[string]any, fields []string) bool {
+	for _, field := range fields {
+		if v, ok := config[field]; ok && v != nil && strings.TrimSpace(fmt.Sprint(v)) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidHostname 检查主机名是否只包含合法的标签
+func isValidHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if len(host) == 0 || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c > 127) {
+				return false
+			}
+		}
+	}
+	return true
+}
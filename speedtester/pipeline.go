@@ -0,0 +1,127 @@
+package speedtester
+
+import (
+	"sort"
+	"sync"
+)
+
+// 分阶段测试中节点通过的阶段
+const (
+	StageLatency    = 1 // 连通且延迟不超过 MaxLatency
+	StageProbe      = 2 // 短测速的下载速度不低于 ProbeMinSpeed
+	StageThroughput = 3 // 完成完整的下载和上传测速
+)
+
+// testStaged 分三个阶段测试节点，避免对每个可用节点都完整测速：
+//  1. 按 Concurrent 并发测试全部节点的连通性和延迟，超过 MaxLatency 的节点淘汰
+//  2. 逐个对剩余节点下载 ProbeSize 做短测速，低于 ProbeMinSpeed 的节点淘汰
+//  3. 按延迟和短测速速度计算评分，只对最好的 StageTopK 个节点完整测速
+//
+// 每个节点在被淘汰或完成测试后立即回调 tester
+func (st *SpeedTester) testStaged(proxies map[string]*CProxy, tester func(result *Result)) {
+	done := func(result *Result) {
+		st.finishResult(result)
+		tester(result)
+	}
+
+	// 1. 并发测试延迟
+	var survivors []*Result
+	for result := range st.testLatencies(proxies) {
+		if result == nil {
+			continue
+		}
+		if result.Latency == 0 || result.Latency > st.config.MaxLatency {
+			done(result)
+			continue
+		}
+		result.Stage = StageLatency
+		survivors = append(survivors, result)
+	}
+	// 中继策略组只测试延迟
+	candidates := survivors[:0]
+	for _, result := range survivors {
+		if result.IsRelay() {
+			done(result)
+			continue
+		}
+		candidates = append(candidates, result)
+	}
+
+	// 2. 短测速，串行进行以免节点之间互相抢占带宽
+	probed := make([]*Result, 0, len(candidates))
+	for _, result := range candidates {
+		if st.stopped() {
+			return
+		}
+		if !st.withinBudget(int64(st.config.ProbeSize)) {
+			result.BudgetExceeded = true
+			done(result)
+			continue
+		}
+		if dr := st.testDownload(result.Proxy, st.config.ProbeSize, st.config.Timeout); dr != nil && dr.err != nil {
+			result.fail(dr.err)
+		} else if dr != nil && dr.duration > 0 {
+			result.ProbeSize = float64(dr.bytes)
+			result.ProbeTime = dr.duration
+			result.ProbeSpeed = float64(dr.bytes) / dr.duration.Seconds()
+		}
+		if result.ProbeSpeed == 0 || result.ProbeSpeed < st.config.ProbeMinSpeed {
+			done(result)
+			continue
+		}
+		result.Stage = StageProbe
+		probed = append(probed, result)
+	}
+
+	// 3. 只对评分最高的 StageTopK 个节点完整测速
+	scores := make(map[*Result]float64, len(probed))
+	for _, result := range probed {
+		scores[result] = st.probeScore(result)
+	}
+	sort.SliceStable(probed, func(i, j int) bool { return scores[probed[i]] > scores[probed[j]] })
+	for i, result := range probed {
+		if st.stopped() {
+			return
+		}
+		if i < st.config.StageTopK {
+			st.testThroughput(result.Proxy, result)
+			// 完整测速失败（如响应校验未通过）或没有测出速度时停留在第二阶段
+			if !result.BudgetExceeded && result.FailReason == "" && (result.DownloadSpeed > 0 || result.UploadSpeed > 0) {
+				result.Stage = StageThroughput
+			}
+		}
+		done(result)
+	}
+}
+
+// testLatencies 按 Concurrent 并发测试全部节点的连通性和延迟，结果在测试完成后依次写入返回的 channel
+func (st *SpeedTester) testLatencies(proxies map[string]*CProxy) <-chan *Result {
+	semaphore := make(chan struct{}, st.config.Concurrent)
+	resultChan := make(chan *Result, len(proxies))
+	var wg sync.WaitGroup
+	for name, proxy := range proxies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			if st.stopped() {
+				return
+			}
+			resultChan <- st.testConnectivity(name, proxy)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+	return resultChan
+}
+
+// probeScore 以短测速的下载速度代替完整测速的结果计算评分，用于第三阶段的选择
+func (st *SpeedTester) probeScore(result *Result) float64 {
+	probe := *result
+	probe.DownloadSpeed = result.ProbeSpeed
+	probe.UploadSpeed = 0
+	return st.score(&probe)
+}
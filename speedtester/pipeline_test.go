@@ -0,0 +1,35 @@
+package speedtester
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTestProxiesContextCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(filterTestConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, config := range []*Config{
+		{ConfigPaths: path, FastMode: true, Timeout: time.Second},
+		{ConfigPaths: path, Timeout: time.Second},
+		{ConfigPaths: path, StageTopK: 1, Timeout: time.Second},
+	} {
+		st := New(config)
+		proxies, err := st.LoadProxies(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tested int
+		st.TestProxiesContext(ctx, proxies, func(*Result) { tested++ })
+		if tested != 0 {
+			t.Errorf("%+v: tested %d proxies after cancel", config, tested)
+		}
+	}
+}
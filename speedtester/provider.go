@@ -0,0 +1,257 @@
+package speedtester
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+	"github.com/metacubex/mihomo/adapter"
+	"github.com/metacubex/mihomo/common/convert"
+	"github.com/metacubex/mihomo/common/structure"
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+	"gopkg.in/yaml.v3"
+)
+
+// providerSchema 对应 proxy-providers 中的一项，字段含义与 mihomo 一致
+type providerSchema struct {
+	Type          string              `provider:"type"`
+	Path          string              `provider:"path,omitempty"`
+	URL           string              `provider:"url,omitempty"`
+	Filter        string              `provider:"filter,omitempty"`
+	ExcludeFilter string              `provider:"exclude-filter,omitempty"`
+	ExcludeType   string              `provider:"exclude-type,omitempty"`
+	DialerProxy   string              `provider:"dialer-proxy,omitempty"`
+	Payload       []map[string]any    `provider:"payload,omitempty"`
+	Override      map[string]any      `provider:"override,omitempty"`
+	Header        map[string][]string `provider:"header,omitempty"`
+}
+
+// providerProxy 表示 provider 中解析出的一个节点及其应用 override 后的配置
+type providerProxy struct {
+	proxy       constant.Proxy
+	config      map[string]any
+	dialerProxy string
+	index       int // 在 provider 内容中的原始位置
+}
+
+// loadProvider 读取并解析 provider，只下载一次。source 为 provider 所在的配置来源，baseDir 用于解析相对路径
+func (st *SpeedTester) loadProvider(name string, mapping map[string]any, source string, baseDir string) ([]*providerProxy, error) {
+	decoder := structure.NewDecoder(structure.Option{TagName: "provider", WeaklyTypedInput: true})
+	schema := &providerSchema{}
+	if err := decoder.Decode(mapping, schema); err != nil {
+		return nil, err
+	}
+
+	var mappings []map[string]any
+	switch schema.Type {
+	case "inline":
+		mappings = schema.Payload
+	case "file":
+		if st.config.DisableFileProviders {
+			return nil, errors.New("file provider is disabled")
+		}
+		buf, err := os.ReadFile(resolvePath(baseDir, schema.Path))
+		if err != nil {
+			return nil, err
+		}
+		if mappings, err = parseProxyList(buf); err != nil {
+			return nil, err
+		}
+	case "http":
+		var buf []byte
+		result, err := st.fetcher.fetch(schema.URL, schema.Header)
+		if err == nil {
+			buf = result.body
+			st.recordSubscription(source, name, result.header)
+		} else if schema.Path != "" && !st.config.DisableFileProviders {
+			// 下载失败时使用 path 指向的本地缓存
+			log.Warnln("Failed to fetch provider %s, fallback to %s: %v", name, schema.Path, err)
+			// 离线时本地缓存也读取失败，仍按跳过处理
+			var readErr error
+			if buf, readErr = os.ReadFile(resolvePath(baseDir, schema.Path)); readErr == nil || !errors.Is(err, errRemoteSkipped) {
+				err = readErr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if mappings, err = parseProxyList(buf); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported provider type: %s", schema.Type)
+	}
+
+	proxies, failures, err := filterProviderProxies(schema, mappings)
+	if err != nil {
+		return nil, err
+	}
+	summary := st.sourceSummary(source, name)
+	summary.Loaded += len(proxies)
+	summary.ParseFailed += len(failures)
+	for _, failure := range failures {
+		st.addIssue(LintError, source, name, failure.Index, failure.Name, "%s", failure.Message)
+	}
+	return proxies, nil
+}
+
+// filterProviderProxies 按 mihomo 的顺序应用 exclude-type、exclude-filter、filter、dialer-proxy 和 override，
+// failures 为解析失败的节点，只填写了 Index、Name 和 Message
+func filterProviderProxies(schema *providerSchema, mappings []map[string]any) (result []*providerProxy, failures []*LintIssue, err error) {
+	excludeFilterReg, err := regexp2.Compile(schema.ExcludeFilter, regexp2.None)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid exclude-filter: %w", err)
+	}
+	var filterRegs []*regexp2.Regexp
+	for _, filter := range strings.Split(schema.Filter, "`") {
+		filterReg, err := regexp2.Compile(filter, regexp2.None)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		filterRegs = append(filterRegs, filterReg)
+	}
+	var excludeTypes []string
+	if schema.ExcludeType != "" {
+		excludeTypes = strings.Split(schema.ExcludeType, "|")
+	}
+
+	seen := make(map[string]bool)
+	// 与 mihomo 一致：多个 filter 依次匹配，结果按 filter 的顺序排列
+	for _, filterReg := range filterRegs {
+		for idx, original := range mappings {
+			proxyType, _ := original["type"].(string)
+			if excluded(excludeTypes, proxyType) {
+				continue
+			}
+			name, ok := original["name"].(string)
+			if !ok {
+				continue
+			}
+			if schema.ExcludeFilter != "" {
+				if matched, _ := excludeFilterReg.MatchString(name); matched {
+					continue
+				}
+			}
+			if schema.Filter != "" {
+				if matched, _ := filterReg.MatchString(name); !matched {
+					continue
+				}
+			}
+			if seen[name] {
+				continue
+			}
+
+			config := make(map[string]any, len(original))
+			for k, v := range original {
+				config[k] = v
+			}
+			if schema.DialerProxy != "" {
+				config["dialer-proxy"] = schema.DialerProxy
+			}
+			if err := applyOverride(config, schema.Override); err != nil {
+				return nil, nil, err
+			}
+
+			proxy, dialerProxy, err := parseProxy(config)
+			if err != nil {
+				log.Debugln("Skip proxy %d in provider: %v", idx, err)
+				seen[name] = true
+				failures = append(failures, &LintIssue{Index: idx, Name: name, Message: fmt.Sprintf("parse proxy: %v", err)})
+				continue
+			}
+			seen[name] = true
+			result = append(result, &providerProxy{
+				proxy:       proxy,
+				config:      config,
+				dialerProxy: dialerProxy,
+				index:       idx,
+			})
+		}
+	}
+	return result, failures, nil
+}
+
+// applyOverride 应用 provider 的 override：additional-prefix、additional-suffix、proxy-name 修改名称，其余字段直接覆盖
+func applyOverride(config map[string]any, override map[string]any) error {
+	for key, value := range override {
+		switch key {
+		case "additional-prefix":
+			config["name"] = fmt.Sprint(value) + config["name"].(string)
+		case "additional-suffix":
+			config["name"] = config["name"].(string) + fmt.Sprint(value)
+		case "proxy-name":
+		default:
+			config[key] = value
+		}
+	}
+
+	rules, _ := override["proxy-name"].([]any)
+	for _, rule := range rules {
+		ruleMap, ok := rule.(map[string]any)
+		if !ok {
+			continue
+		}
+		pattern, _ := ruleMap["pattern"].(string)
+		target, _ := ruleMap["target"].(string)
+		re, err := regexp2.Compile(pattern, regexp2.None)
+		if err != nil {
+			return fmt.Errorf("invalid override proxy-name pattern: %w", err)
+		}
+		newName, err := re.Replace(config["name"].(string), target, 0, -1)
+		if err != nil {
+			return fmt.Errorf("override proxy-name: %w", err)
+		}
+		config["name"] = newName
+	}
+	return nil
+}
+
+// parseProxy 解析节点配置，dialer-proxy 由 chainBuilder 组装，节点本身不带此项解析
+func parseProxy(config map[string]any) (constant.Proxy, string, error) {
+	dialerProxy, _ := config["dialer-proxy"].(string)
+	parseConfig := config
+	if dialerProxy != "" {
+		parseConfig = make(map[string]any, len(config))
+		for k, v := range config {
+			if k != "dialer-proxy" {
+				parseConfig[k] = v
+			}
+		}
+	}
+	proxy, err := adapter.ParseProxy(parseConfig)
+	return proxy, dialerProxy, err
+}
+
+// parseProxyList 解析 provider 内容，支持 Clash YAML 和 V2Ray 订阅链接
+func parseProxyList(buf []byte) ([]map[string]any, error) {
+	rawCfg := &RawConfig{}
+	if err := yaml.Unmarshal(buf, rawCfg); err == nil && rawCfg.Proxies != nil {
+		return rawCfg.Proxies, nil
+	}
+	proxies, err := convert.ConvertsV2Ray(buf)
+	if err != nil {
+		return nil, fmt.Errorf("provider must have a `proxies` field or be a subscription link list: %w", err)
+	}
+	return proxies, nil
+}
+
+func excluded(excludeTypes []string, proxyType string) bool {
+	for _, t := range excludeTypes {
+		if strings.EqualFold(t, proxyType) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath 将相对路径解析为相对于配置文件所在目录的路径
+func resolvePath(baseDir string, path string) string {
+	if filepath.IsAbs(path) || baseDir == "" {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
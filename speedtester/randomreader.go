@@ -0,0 +1,113 @@
+package speedtester
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 测速服务器下载内容的模式
+const (
+	PayloadZero   = "zero"   // 全零，Cloudflare 测速服务器和默认的 download-server
+	PayloadRandom = "random" // RandomReader 生成的伪随机数据，需要 download-server -payload random
+)
+
+// RandomReader 生成 size 字节不可压缩的伪随机数据，相同的 seed 总是生成相同的内容。
+// 第 i 个 8 字节块为 splitmix64(seed+i)，任意位置的内容都可以直接计算，用于校验下载的数据
+type RandomReader struct {
+	seed         uint64
+	remainBytes  int64
+	writtenBytes int64
+}
+
+func NewRandomReader(size int, seed uint64) *RandomReader {
+	return &RandomReader{
+		seed:        seed,
+		remainBytes: int64(size),
+	}
+}
+
+func (r *RandomReader) Read(p []byte) (n int, err error) {
+	if r.remainBytes <= 0 {
+		return 0, io.EOF
+	}
+	n = int(min(int64(len(p)), r.remainBytes))
+	fillRandom(p[:n], r.seed, r.writtenBytes)
+	r.remainBytes -= int64(n)
+	r.writtenBytes += int64(n)
+	return n, nil
+}
+
+func (r *RandomReader) WrittenBytes() int64 {
+	return r.writtenBytes
+}
+
+func (r *RandomReader) RemainBytes() int64 {
+	return r.remainBytes
+}
+
+// splitmix64 返回序列中第 i 个值
+func splitmix64(seed, i uint64) uint64 {
+	z := seed + (i+1)*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// fillRandom 用 seed 对应数据流中从 offset 开始的内容填充 p
+func fillRandom(p []byte, seed uint64, offset int64) {
+	var block [8]byte
+	for len(p) > 0 {
+		index, skip := uint64(offset/8), int(offset%8)
+		if skip == 0 && len(p) >= 8 {
+			binary.LittleEndian.PutUint64(p, splitmix64(seed, index))
+			p = p[8:]
+			offset += 8
+			continue
+		}
+		binary.LittleEndian.PutUint64(block[:], splitmix64(seed, index))
+		n := copy(p, block[skip:])
+		p = p[n:]
+		offset += int64(n)
+	}
+}
+
+// PayloadVerifier 校验写入的数据是否与测速服务器生成的内容一致，
+// seed 为 nil 时期望全零（Cloudflare 和默认的 download-server），否则期望 RandomReader 生成的内容
+type PayloadVerifier struct {
+	seed     *uint64
+	offset   int64
+	mismatch int64 // 第一个不一致的位置，-1 表示全部一致
+	expected [32 * 1024]byte
+}
+
+func NewPayloadVerifier(seed *uint64) *PayloadVerifier {
+	return &PayloadVerifier{seed: seed, mismatch: -1}
+}
+
+func (v *PayloadVerifier) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 && v.mismatch < 0 {
+		chunk := v.expected[:min(len(p), len(v.expected))]
+		if v.seed != nil {
+			fillRandom(chunk, *v.seed, v.offset)
+		}
+		for i := range chunk {
+			if p[i] != chunk[i] {
+				v.mismatch = v.offset + int64(i)
+				break
+			}
+		}
+		p = p[len(chunk):]
+		v.offset += int64(len(chunk))
+	}
+	return total, nil
+}
+
+// Err 返回第一个不一致的位置
+func (v *PayloadVerifier) Err() error {
+	if v.mismatch < 0 {
+		return nil
+	}
+	return fmt.Errorf("payload mismatch at byte %d", v.mismatch)
+}
@@ -0,0 +1,213 @@
+package speedtester
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 排序依据
+const (
+	SortByLatency    = "latency"
+	SortByJitter     = "jitter"
+	SortByPacketLoss = "packet_loss"
+	SortByDownload   = "download"
+	SortByUpload     = "upload"
+	SortByScore      = "score"
+	SortByName       = "name"
+)
+
+// resultLess 返回按 key 排序时 a 是否优于 b，未测出的值排在最后
+func resultLess(key string) (func(a, b *Result) bool, error) {
+	switch key {
+	case SortByLatency:
+		return func(a, b *Result) bool { return lessPositive(a.Latency, b.Latency) }, nil
+	case SortByJitter:
+		return aliveFirst(func(a, b *Result) bool { return a.Jitter < b.Jitter }), nil
+	case SortByPacketLoss:
+		return aliveFirst(func(a, b *Result) bool { return a.PacketLoss < b.PacketLoss }), nil
+	case SortByDownload:
+		return func(a, b *Result) bool { return a.DownloadSpeed > b.DownloadSpeed }, nil
+	case SortByUpload:
+		return func(a, b *Result) bool { return a.UploadSpeed > b.UploadSpeed }, nil
+	case SortByScore:
+		return func(a, b *Result) bool { return a.Score > b.Score }, nil
+	case SortByName:
+		return func(a, b *Result) bool { return a.ProxyName < b.ProxyName }, nil
+	}
+	return nil, fmt.Errorf("unknown sort key %q", key)
+}
+
+// aliveFirst 将不可用的节点排在最后，可用节点之间按 less 比较。
+// 不可用或未测试的节点抖动和丢包率都为 0，直接比较会排在最前
+func aliveFirst(less func(a, b *Result) bool) func(a, b *Result) bool {
+	return func(a, b *Result) bool {
+		if (a.Latency > 0) != (b.Latency > 0) {
+			return a.Latency > 0
+		}
+		return less(a, b)
+	}
+}
+
+// lessPositive 比较两个值，0 表示未测出，排在最后
+func lessPositive[T ~int64 | ~float64](a, b T) bool {
+	if a == 0 || b == 0 {
+		return a != 0
+	}
+	return a < b
+}
+
+// ScoreWeights 是综合评分中各项指标的权重，权重为 0 的指标不参与评分
+type ScoreWeights struct {
+	Latency    float64
+	Jitter     float64
+	PacketLoss float64
+	Download   float64
+	Upload     float64
+	Stability  float64 // 历史可用率，没有历史记录时视为完全稳定
+}
+
+// DefaultScoreWeights 是默认的评分权重
+var DefaultScoreWeights = ScoreWeights{
+	Latency:    0.3,
+	Jitter:     0.1,
+	PacketLoss: 0.1,
+	Download:   0.3,
+	Upload:     0.1,
+	Stability:  0.1,
+}
+
+// 各项指标得分为 0.5 时的参考值
+const (
+	scoreLatencyRef  = 200 * time.Millisecond
+	scoreJitterRef   = 50 * time.Millisecond
+	scoreDownloadRef = 10 * 1024 * 1024
+	scoreUploadRef   = 5 * 1024 * 1024
+)
+
+// ParseScoreWeights 解析 latency=0.4,download=0.4 形式的权重，未指定的指标使用默认权重
+func ParseScoreWeights(s string) (ScoreWeights, error) {
+	weights := DefaultScoreWeights
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return weights, fmt.Errorf("invalid weight %q, expected key=value", item)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return weights, fmt.Errorf("invalid weight %q", item)
+		}
+		switch strings.TrimSpace(key) {
+		case "latency":
+			weights.Latency = weight
+		case "jitter":
+			weights.Jitter = weight
+		case "packet_loss":
+			weights.PacketLoss = weight
+		case "download":
+			weights.Download = weight
+		case "upload":
+			weights.Upload = weight
+		case "stability":
+			weights.Stability = weight
+		default:
+			return weights, fmt.Errorf("unknown weight %q", key)
+		}
+	}
+	return weights, nil
+}
+
+// score 计算 0-100 的综合评分，不可用的节点为 0。
+// 每项指标先映射到 0-1（参考值处为 0.5），再按权重加权平均；本次没有测试的下载、上传不参与评分
+func (st *SpeedTester) score(result *Result) float64 {
+	if result.Latency == 0 {
+		return 0
+	}
+	weights := st.config.ScoreWeights
+	if weights == nil {
+		weights = &DefaultScoreWeights
+	}
+
+	var total, weightSum float64
+	add := func(weight, value float64) {
+		if weight > 0 {
+			total += weight * value
+			weightSum += weight
+		}
+	}
+	add(weights.Latency, decay(float64(result.Latency), float64(scoreLatencyRef)))
+	add(weights.Jitter, decay(float64(result.Jitter), float64(scoreJitterRef)))
+	add(weights.PacketLoss, 1-min(result.PacketLoss, 100)/100)
+	if !st.config.FastMode && st.config.DownloadSize > 0 {
+		add(weights.Download, growth(result.DownloadSpeed, scoreDownloadRef))
+	}
+	if !st.config.FastMode && st.config.UploadSize > 0 {
+		add(weights.Upload, growth(result.UploadSpeed, scoreUploadRef))
+	}
+	stability := 1.0
+	if st.config.Stability != nil {
+		if uptime, ok := st.config.Stability(result.Fingerprint); ok {
+			stability = uptime
+		}
+	}
+	add(weights.Stability, stability)
+
+	if weightSum == 0 {
+		return 0
+	}
+	return total / weightSum * 100
+}
+
+// decay 越小越好的指标，0 时为 1，ref 时为 0.5
+func decay(value, ref float64) float64 {
+	return ref / (ref + max(value, 0))
+}
+
+// growth 越大越好的指标，0 时为 0，ref 时为 0.5
+func growth(value, ref float64) float64 {
+	value = max(value, 0)
+	return value / (ref + value)
+}
+
+// sortBy 返回结果的排序依据，未设置时快速模式按延迟，否则按下载速度
+func (st *SpeedTester) sortBy() string {
+	if st.config.SortBy != "" {
+		return st.config.SortBy
+	}
+	if st.config.FastMode {
+		return SortByLatency
+	}
+	return SortByDownload
+}
+
+// SortResults 按 SortBy 对结果排序，相同时按名称排序
+func (st *SpeedTester) SortResults(results []*Result) {
+	less, err := resultLess(st.sortBy())
+	if err != nil {
+		less, _ = resultLess(SortByName)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if less(results[i], results[j]) {
+			return true
+		}
+		if less(results[j], results[i]) {
+			return false
+		}
+		return results[i].ProxyName < results[j].ProxyName
+	})
+}
+
+// ValidateSortKey 检查排序依据是否有效
+func ValidateSortKey(key string) error {
+	if key == "" {
+		return nil
+	}
+	_, err := resultLess(key)
+	return err
+}
@@ -0,0 +1,20 @@
+package speedtester
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSortResultsDeadLast(t *testing.T) {
+	for _, key := range []string{SortByLatency, SortByJitter, SortByPacketLoss, SortByDownload} {
+		results := []*Result{
+			{ProxyName: "dead"},
+			{ProxyName: "slow", Latency: 300 * time.Millisecond, Jitter: 40 * time.Millisecond, PacketLoss: 10, DownloadSpeed: 1},
+			{ProxyName: "fast", Latency: 50 * time.Millisecond, Jitter: 0, PacketLoss: 0, DownloadSpeed: 2},
+		}
+		New(&Config{SortBy: key}).SortResults(results)
+		if results[0].ProxyName != "fast" || results[2].ProxyName != "dead" {
+			t.Errorf("sort by %s: got %s, %s, %s", key, results[0].ProxyName, results[1].ProxyName, results[2].ProxyName)
+		}
+	}
+}
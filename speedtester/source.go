@@ -0,0 +1,109 @@
+package speedtester
+
+import (
+	"sort"
+	"time"
+)
+
+// SourceSummary 汇总单个配置来源（或其中一个 provider）的加载和测试情况
+type SourceSummary struct {
+	Source          string        `json:"source"`             // 配置来源，已去掉凭据和查询参数
+	Provider        string        `json:"provider,omitempty"` // provider 名称，配置中直接定义的节点为空
+	Error           string        `json:"error,omitempty"`    // 来源加载失败的原因
+	Loaded          int           `json:"loaded"`             // 解析成功的节点数
+	ParseFailed     int           `json:"parse_failed"`       // 解析失败的节点数
+	Tested          int           `json:"tested"`
+	Passed          int           `json:"passed"` // 满足延迟和速度要求的节点数
+	MedianLatency   time.Duration `json:"median_latency"`
+	MedianDownload  float64       `json:"median_download_speed"`
+	passedLatencies []time.Duration
+	passedSpeeds    []float64
+}
+
+type sourceKey struct {
+	source   string
+	provider string
+}
+
+// sourceSummary 返回来源对应的统计项，不存在时按出现顺序创建
+func (st *SpeedTester) sourceSummary(source string, provider string) *SourceSummary {
+	key := sourceKey{source: source, provider: provider}
+	if summary, ok := st.sources[key]; ok {
+		return summary
+	}
+	summary := &SourceSummary{Source: RedactSource(source), Provider: provider}
+	st.sources[key] = summary
+	st.sourceOrder = append(st.sourceOrder, key)
+	return summary
+}
+
+// Passed 判断结果是否通过响应校验，并满足配置中的延迟、速度要求、筛选表达式和国家筛选
+func (st *SpeedTester) Passed(result *Result) bool {
+	if result.Latency == 0 || result.FailReason != "" {
+		return false
+	}
+	if st.config.MaxLatency > 0 && result.Latency > st.config.MaxLatency {
+		return false
+	}
+	if !st.MatchResult(result) || !st.matchCountry(result) {
+		return false
+	}
+	if st.config.FastMode {
+		return true
+	}
+	if st.config.DownloadSize > 0 && st.config.MinDownloadSpeed > 0 && result.DownloadSpeed < st.config.MinDownloadSpeed {
+		return false
+	}
+	if st.config.UploadSize > 0 && st.config.MinUploadSpeed > 0 && result.UploadSpeed < st.config.MinUploadSpeed {
+		return false
+	}
+	return true
+}
+
+// SummarizeSources 按来源汇总最近一次 LoadProxies 的加载情况和 results 的测试情况。
+// 合并的重复节点计入保留节点的来源
+func (st *SpeedTester) SummarizeSources(results []*Result) []*SourceSummary {
+	summaries := make(map[sourceKey]*SourceSummary, len(st.sourceOrder))
+	for _, key := range st.sourceOrder {
+		summary := *st.sources[key]
+		summaries[key] = &summary
+	}
+
+	for _, result := range results {
+		if result.IsRelay() {
+			continue
+		}
+		summary, ok := summaries[sourceKey{source: result.Source, provider: result.Provider}]
+		if !ok {
+			continue
+		}
+		summary.Tested++
+		if st.Passed(result) {
+			summary.Passed++
+			summary.passedLatencies = append(summary.passedLatencies, result.Latency)
+			summary.passedSpeeds = append(summary.passedSpeeds, result.DownloadSpeed)
+		}
+	}
+
+	output := make([]*SourceSummary, 0, len(st.sourceOrder))
+	for _, key := range st.sourceOrder {
+		summary := summaries[key]
+		summary.MedianLatency = median(summary.passedLatencies)
+		summary.MedianDownload = median(summary.passedSpeeds)
+		output = append(output, summary)
+	}
+	return output
+}
+
+func median[T time.Duration | float64](values []T) T {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]T(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
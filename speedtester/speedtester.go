@@ -3,20 +3,26 @@ package speedtester
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/metacubex/mihomo/adapter"
+	"github.com/faceair/clash-speedtest/filter"
 	"github.com/metacubex/mihomo/adapter/provider"
+	"github.com/metacubex/mihomo/common/convert"
 	"github.com/metacubex/mihomo/log"
 	"gopkg.in/yaml.v3"
 
@@ -24,24 +30,71 @@ import (
 )
 
 type Config struct {
-	ConfigPaths      string
-	FilterRegex      string
-	BlockRegex       string
-	ServerURL        string
-	DownloadSize     int
-	UploadSize       int
-	Timeout          time.Duration
-	Concurrent       int
-	MaxLatency       time.Duration
-	MinDownloadSpeed float64
-	MinUploadSpeed   float64
-	FastMode         bool
+	ConfigPaths          string
+	FilterRegex          string
+	BlockRegex           string
+	ServerURL            string
+	DownloadSize         int
+	UploadSize           int
+	Timeout              time.Duration
+	Concurrent           int
+	MaxLatency           time.Duration
+	MinDownloadSpeed     float64
+	MinUploadSpeed       float64
+	FastMode             bool
+	DedupMode            string        // 去重模式：none、exact（默认）、endpoint、exit-ip
+	Groups               string        // 只测试这些策略组（逗号分隔）中的节点，为空表示不限制
+	DisableFileProviders bool          // 不读取本地 provider 文件，用于处理不受信任的配置
+	UserAgent            string        // 下载订阅使用的 User-Agent，默认 clash.meta
+	FetchHeaders         http.Header   // 下载订阅附加的请求头
+	FetchTimeout         time.Duration // 下载订阅的超时时间，默认 30s
+	FetchRetries         int           // 下载订阅失败后的重试次数
+	CacheDir             string        // 订阅缓存目录，为空表示不缓存
+	FetchProxy           string        // 下载订阅使用的代理，如 http://127.0.0.1:7890、socks5://127.0.0.1:1080
+	FilterExpr           string        // 筛选表达式，见 filter 包；节点属性在测试前过滤，测试结果在测试后过滤
+	Countries            string        // 只保留出口 IP 在这些国家（逗号分隔的国家代码）的节点
+	ExcludeCountries     string        // 排除出口 IP 在这些国家的节点
+	TopPerCountry        int           // 每个出口国家只保留最好的 N 个节点，0 表示不限制
+	TopBy                string        // 选取每个国家最好节点的排序依据，见 SortBy*
+	SortBy               string        // 结果的排序依据，见 SortBy*
+	ScoreWeights         *ScoreWeights // 综合评分的权重，为空时使用 DefaultScoreWeights
+	// Stability 返回节点（按指纹）的历史可用率（0-1），没有历史记录时返回 false
+	Stability func(fingerprint string) (float64, bool)
+	// 分阶段测试，见 testStaged。StageTopK 大于 0 且不是快速模式时启用
+	StageTopK     int     // 第三阶段只对第二阶段评分最高的 K 个节点完整测速
+	ProbeSize     int     // 第二阶段短测速的下载量，默认 1MB
+	ProbeMinSpeed float64 // 第二阶段下载速度低于此值的节点不进入第三阶段
+	TrafficBudget int64   // 本次测试经过代理的流量上限（字节），剩余预算不足时跳过带宽测试，0 表示不限制
+	Payload       string  // 测速服务器下载内容的模式，见 Payload*，默认 zero
+	VerifyPayload bool    // 校验下载的内容是否符合 Payload，不一致的节点视为不可用
+	AcceptStatus  []int   // 延迟测试接受的状态码，默认 DefaultAcceptStatus
+	ServerToken   string  // 测速服务器需要的 Bearer token，见 download-server -token
+	PingCount     int     // 大于 0 时通过测速服务器的 WebSocket echo 连续测量 PingCount 次延迟，计算抖动和丢包率（需要 download-server）
+	UDPEcho       string  // download-server 的 UDP echo 地址（host:port），非空时测试节点的 UDP 延迟和丢包率
+	// 原始 TCP 测速，见 testStream。StreamServer 为 download-server -stream 的地址（host:port），非空时启用
+	StreamServer   string
+	StreamDuration time.Duration // 每个方向持续收发的时长，默认 5s
+	Normalize      bool          // 按直连基准（见 TestBaseline）的百分比表示节点的延迟和速度
 }
 
 type SpeedTester struct {
 	config           *Config
 	blockedNodes     []string
 	blockedNodeCount int
+	duplicateCount   int
+	groups           []*ProxyGroup
+	fetcher          *fetcher
+	subscriptions    []*SubscriptionInfo
+	sources          map[sourceKey]*SourceSummary
+	sourceOrder      []sourceKey
+	issues           []*LintIssue
+	linting          bool // 由 Lint 设置，只做静态检查，不下载远程来源，也不进行需要联网的去重
+	nodeFilter       *filter.Expr
+	resultFilter     *filter.Expr
+	filterRegexp     *regexp.Regexp
+	traffic          trafficCounter  // 本次测试经过代理的总流量
+	baseline         *Result         // 直连基准，见 TestBaseline
+	ctx              context.Context // 由 TestProxiesContext 设置，取消后不再开始新的测试
 }
 
 func New(config *Config) *SpeedTester {
@@ -54,6 +107,18 @@ func New(config *Config) *SpeedTester {
 	if config.UploadSize < 0 {
 		config.UploadSize = 10 * 1024 * 1024
 	}
+	if config.DedupMode == "" {
+		config.DedupMode = DedupExact
+	}
+	if config.Payload == "" {
+		config.Payload = PayloadZero
+	}
+	if config.ProbeSize <= 0 {
+		config.ProbeSize = 1024 * 1024
+	}
+	if config.StreamDuration <= 0 {
+		config.StreamDuration = 5 * time.Second
+	}
 	return &SpeedTester{
 		config: config,
 	}
@@ -61,18 +126,60 @@ func New(config *Config) *SpeedTester {
 
 type CProxy struct {
 	constant.Proxy
-	Config map[string]any
+	Config      map[string]any
+	Source      string   // 节点来源的配置文件路径或订阅地址
+	Provider    string   // 节点所在的 provider 名称，配置中直接定义的节点为空
+	Index       int      // 节点在来源的 proxies 或 provider 中的原始位置
+	Fingerprint string   // 与名称无关的节点指纹，见 Fingerprint
+	Aliases     []string // 去重时合并到此节点的其他节点名称
+	Sources     []string // 此节点及其重复节点的全部来源
+	Chain       []string // 链式节点的各跳名称，第一跳在前；非链式节点为空
+
+	dialerProxy string     // 配置中的 dialer-proxy，节点本身解析时不带此项
+	upstream    *CProxy    // dialer-proxy 解析到的上游节点
+	hops        []chainHop // 链式节点的各跳
 }
 
 type RawConfig struct {
-	Providers map[string]map[string]any `yaml:"proxy-providers"`
-	Proxies   []map[string]any          `yaml:"proxies"`
+	Providers   map[string]map[string]any `yaml:"proxy-providers"`
+	Proxies     []map[string]any          `yaml:"proxies"`
+	ProxyGroups []map[string]any          `yaml:"proxy-groups,omitempty"`
 }
 
 func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, error) {
 	allProxies := make(map[string]*CProxy)
+	dedupKeys := make(map[string]string) // 去重标识 -> 保留的节点名
 	st.blockedNodes = make([]string, 0)
 	st.blockedNodeCount = 0
+	st.duplicateCount = 0
+	st.groups = nil
+	st.subscriptions = nil
+	st.sources = make(map[sourceKey]*SourceSummary)
+	st.sourceOrder = nil
+	st.issues = nil
+	st.traffic.sent.Store(0)
+	st.traffic.received.Store(0)
+
+	var err error
+	if st.fetcher, err = newFetcher(st.config); err != nil {
+		return nil, err
+	}
+	st.fetcher.offline = st.linting
+	if st.nodeFilter, st.resultFilter, err = ParseFilter(st.config.FilterExpr); err != nil {
+		return nil, err
+	}
+	if st.filterRegexp, err = regexp.Compile(st.config.FilterRegex); err != nil {
+		return nil, err
+	}
+	if err := ValidateSortKey(st.config.TopBy); err != nil {
+		return nil, err
+	}
+	if st.config.Payload != PayloadZero && st.config.Payload != PayloadRandom {
+		return nil, fmt.Errorf("unknown payload %q", st.config.Payload)
+	}
+	if err := ValidateSortKey(st.config.SortBy); err != nil {
+		return nil, err
+	}
 
 	for _, configPath := range strings.Split(st.config.ConfigPaths, ",") {
 		configPath = strings.TrimSpace(configPath)
@@ -82,25 +189,31 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 
 		var body []byte
 		var err error
+		summary := st.sourceSummary(configPath, "")
 
 		// 获取配置内容
 		if strings.HasPrefix(configPath, "http") {
-			var resp *http.Response
-			resp, err = http.Get(configPath)
-			if err != nil {
-				log.Warnln("Failed to fetch config from %s: %v", configPath, err)
+			var result *fetchResult
+			result, err = st.fetcher.fetch(configPath, nil)
+			if errors.Is(err, errRemoteSkipped) {
+				summary.Error = err.Error()
+				st.addIssue(LintWarning, configPath, "", -1, "", "%v", err)
 				continue
 			}
-			defer resp.Body.Close()
-			body, err = io.ReadAll(resp.Body)
 			if err != nil {
-				log.Warnln("Failed to read config from %s: %v", configPath, err)
+				log.Warnln("Failed to fetch config from %s: %v", configPath, err)
+				summary.Error = err.Error()
+				st.addIssue(LintError, configPath, "", -1, "", "fetch config: %v", err)
 				continue
 			}
+			body = result.body
+			st.recordSubscription(configPath, "", result.header)
 		} else {
 			body, err = os.ReadFile(configPath)
 			if err != nil {
 				log.Warnln("Failed to read config file %s: %v", configPath, err)
+				summary.Error = err.Error()
+				st.addIssue(LintError, configPath, "", -1, "", "read config: %v", err)
 				continue
 			}
 		}
@@ -109,22 +222,38 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 		rawCfg := &RawConfig{
 			Proxies: []map[string]any{},
 		}
-		if err := yaml.Unmarshal(body, rawCfg); err != nil {
-			log.Warnln("Failed to parse config %s: %v", configPath, err)
-			continue
+		if err := yaml.Unmarshal(body, rawCfg); err != nil || (len(rawCfg.Proxies) == 0 && len(rawCfg.Providers) == 0) {
+			// 不是 Clash 配置时按订阅链接列表解析
+			links, convertErr := convert.ConvertsV2Ray(body)
+			if convertErr != nil {
+				log.Warnln("Failed to parse config %s: %v", configPath, errors.Join(err, convertErr))
+				summary.Error = errors.Join(err, convertErr).Error()
+				st.addIssue(LintError, configPath, "", -1, "", "parse config: %v", errors.Join(err, convertErr))
+				continue
+			}
+			rawCfg.Proxies = links
 		}
 
 		proxies := make(map[string]*CProxy)
 		proxiesConfig := rawCfg.Proxies
 		providersConfig := rawCfg.Providers
+		groupSrc := &groupSource{
+			path:      configPath,
+			providers: make(map[string][]groupMember),
+		}
 
 		// 加载直接定义的代理
 		for i, config := range proxiesConfig {
-			proxy, err := adapter.ParseProxy(config)
+			// dialer-proxy 在加载完所有节点后再组装
+			proxy, dialerProxy, err := parseProxy(config)
 			if err != nil {
 				log.Debugln("Skip proxy %d in %s: %v", i, configPath, err)
+				summary.ParseFailed++
+				proxyName, _ := config["name"].(string)
+				st.addIssue(LintError, configPath, "", i, proxyName, "parse proxy: %v", err)
 				continue
 			}
+			summary.Loaded++
 
 			// 处理重名
 			proxyName := proxy.Name()
@@ -139,102 +268,101 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 					counter++
 				}
 				log.Debugln("Renamed duplicate proxy: %s -> %s", proxy.Name(), proxyName)
+				st.addIssue(LintWarning, configPath, "", i, proxy.Name(), "duplicate name, renamed to %s", proxyName)
 			}
-			proxies[proxyName] = &CProxy{Proxy: proxy, Config: config}
+			proxies[proxyName] = &CProxy{Proxy: proxy, Config: config, Source: configPath, Index: i, dialerProxy: dialerProxy}
+			groupSrc.proxies = append(groupSrc.proxies, groupMember{name: proxy.Name(), proxy: proxies[proxyName]})
 		}
 
-		// 加载 provider 中的代理
-		for name, config := range providersConfig {
+		// 加载 provider 中的代理，每个 provider 只读取一次
+		baseDir := ""
+		if !strings.HasPrefix(configPath, "http") {
+			baseDir = filepath.Dir(configPath)
+		}
+		providerNames := make([]string, 0, len(providersConfig))
+		for name := range providersConfig {
+			providerNames = append(providerNames, name)
+		}
+		sort.Strings(providerNames)
+		for _, name := range providerNames {
 			if name == provider.ReservedName {
 				log.Warnln("Skip reserved provider name: %s", provider.ReservedName)
+				st.addIssue(LintError, configPath, name, -1, "", "reserved provider name")
 				continue
 			}
 
-			pd, err := provider.ParseProxyProvider(name, config)
-			if err != nil {
-				log.Warnln("Failed to parse provider %s: %v", name, err)
-				continue
-			}
-
-			if err := pd.Initial(); err != nil {
-				log.Warnln("Failed to initialize provider %s: %v", name, err)
+			pdProxies, err := st.loadProvider(name, providersConfig[name], configPath, baseDir)
+			if errors.Is(err, errRemoteSkipped) {
+				st.sourceSummary(configPath, name).Error = err.Error()
+				st.addIssue(LintWarning, configPath, name, -1, "", "%v", err)
 				continue
 			}
-
-			// 获取 provider 的配置
-			urlStr, ok := config["url"].(string)
-			if !ok {
-				log.Warnln("Provider %s has no valid URL", name)
-				continue
-			}
-
-			resp, err := http.Get(urlStr)
 			if err != nil {
-				log.Warnln("Failed to fetch provider %s from %s: %v", name, urlStr, err)
-				continue
-			}
-
-			providerBody, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			if err != nil {
-				log.Warnln("Failed to read provider %s: %v", name, err)
-				continue
-			}
-
-			pdRawCfg := &RawConfig{
-				Proxies: []map[string]any{},
-			}
-			if err := yaml.Unmarshal(providerBody, pdRawCfg); err != nil {
-				log.Warnln("Failed to parse provider %s config: %v", name, err)
+				log.Warnln("Failed to load provider %s: %v", name, err)
+				st.sourceSummary(configPath, name).Error = err.Error()
+				st.addIssue(LintError, configPath, name, -1, "", "load provider: %v", err)
 				continue
 			}
 
-			// 建立 provider 代理配置映射
-			pdProxies := make(map[string]map[string]any)
-			for _, pdProxy := range pdRawCfg.Proxies {
-				if proxyName, ok := pdProxy["name"].(string); ok {
-					pdProxies[proxyName] = pdProxy
-				}
-			}
-
-			// 添加 provider 中的代理
-			for _, proxy := range pd.Proxies() {
-				proxyName := fmt.Sprintf("[%s] %s", name, proxy.Name())
-				if proxyConfig, ok := pdProxies[proxy.Name()]; ok {
-					// 处理重名
-					finalName := proxyName
-					if _, exist := proxies[finalName]; exist {
-						counter := 1
-						for {
-							newName := fmt.Sprintf("%s-重名%d", proxyName, counter)
-							if _, exist := proxies[newName]; !exist {
-								finalName = newName
-								break
-							}
-							counter++
+			for _, pdProxy := range pdProxies {
+				proxyName := fmt.Sprintf("[%s] %s", name, pdProxy.proxy.Name())
+				// 处理重名
+				finalName := proxyName
+				if _, exist := proxies[finalName]; exist {
+					counter := 1
+					for {
+						newName := fmt.Sprintf("%s-重名%d", proxyName, counter)
+						if _, exist := proxies[newName]; !exist {
+							finalName = newName
+							break
 						}
-						log.Debugln("Renamed duplicate proxy: %s -> %s", proxyName, finalName)
-					}
-					proxies[finalName] = &CProxy{
-						Proxy:  proxy,
-						Config: proxyConfig,
+						counter++
 					}
-				} else {
-					log.Debugln("No config found for proxy %s in provider %s", proxy.Name(), name)
+					log.Debugln("Renamed duplicate proxy: %s -> %s", proxyName, finalName)
+					st.addIssue(LintWarning, configPath, name, pdProxy.index, pdProxy.proxy.Name(), "duplicate name, renamed to %s", finalName)
 				}
+				proxies[finalName] = &CProxy{
+					Proxy:       pdProxy.proxy,
+					Config:      pdProxy.config,
+					Source:      configPath,
+					Provider:    name,
+					Index:       pdProxy.index,
+					dialerProxy: pdProxy.dialerProxy,
+				}
+				groupSrc.providers[name] = append(groupSrc.providers[name], groupMember{name: pdProxy.proxy.Name(), proxy: proxies[finalName]})
 			}
 		}
 
-		// 过滤和合并代理
-		for k, p := range proxies {
+		// 组装 relay 策略组和 dialer-proxy 链路
+		builder := newChainBuilder(groupSrc, rawCfg.ProxyGroups)
+		for _, relay := range builder.buildRelays(rawCfg.ProxyGroups, configPath) {
+			relayName := relay.Name()
+			if _, exist := proxies[relayName]; exist {
+				relayName = fmt.Sprintf("%s-relay", relayName)
+			}
+			proxies[relayName] = relay
+		}
+		builder.applyDialerProxies(proxies)
+		st.issues = append(st.issues, builder.issues...)
+
+		// 过滤和合并代理，按名称顺序处理以保证去重时保留的节点稳定
+		names := make([]string, 0, len(proxies))
+		for k := range proxies {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		finalNames := make(map[*CProxy]string, len(names)) // 节点 -> 合并后的名称，用于展开策略组
+		for _, k := range names {
+			p := proxies[k]
 			// 检查代理类型
 			switch p.Type() {
 			case constant.Shadowsocks, constant.ShadowsocksR, constant.Snell, constant.Socks5, constant.Http,
 				constant.Vmess, constant.Vless, constant.Trojan, constant.Hysteria, constant.Hysteria2,
-				constant.WireGuard, constant.Tuic, constant.Ssh, constant.Mieru, constant.AnyTLS:
+				constant.WireGuard, constant.Tuic, constant.Ssh, constant.Mieru, constant.AnyTLS, constant.Relay:
 				// 支持的类型
 			default:
 				log.Debugln("Skip unsupported proxy type %s: %s", p.Type(), k)
+				st.addProxyIssue(LintError, p, k, "unsupported proxy type %s", p.Type())
 				continue
 			}
 
@@ -246,6 +374,30 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 			// Stash 兼容性检查
 			if stashCompatible && !isStashCompatible(p) {
 				log.Debugln("Skip non-Stash-compatible proxy: %s", k)
+				st.addProxyIssue(LintError, p, k, "not compatible with Stash")
+				continue
+			}
+
+			if st.linting && p.Type() != constant.Relay {
+				st.lintProxy(k, p)
+			}
+
+			// 先过滤再去重，避免被过滤的节点作为保留的节点，导致其他来源中满足条件的重复节点一起被丢弃。
+			// 筛选表达式可以使用 fingerprint，需要先计算
+			p.Fingerprint = Fingerprint(p.Config)
+			if !st.matchNodeFilters(k, p) {
+				continue
+			}
+
+			// 去重，同一节点在多个来源中只测试一次
+			p.Sources = []string{p.Source}
+			key := st.dedupKey(p)
+			if existing, ok := dedupKeys[key]; ok && key != "" {
+				mergeDuplicate(allProxies[existing], p, k)
+				finalNames[p] = existing
+				st.duplicateCount++
+				log.Debugln("Collapse duplicate proxy %s into %s", k, existing)
+				st.addProxyIssue(LintWarning, p, k, "duplicate of %s", existing)
 				continue
 			}
 
@@ -262,52 +414,36 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 					counter++
 				}
 				log.Debugln("Renamed duplicate proxy across configs: %s -> %s", k, finalName)
+				st.addProxyIssue(LintWarning, p, k, "duplicate name across configs, renamed to %s", finalName)
 			}
 			allProxies[finalName] = p
+			finalNames[p] = finalName
+			if key != "" {
+				dedupKeys[key] = finalName
+			}
 		}
+
+		st.groups = append(st.groups, resolveGroups(groupSrc, rawCfg.ProxyGroups, finalNames)...)
 	}
 
 	log.Infoln("Loaded %d proxies from all configs", len(allProxies))
 
-	// 应用过滤规则
-	filterRegexp := regexp.MustCompile(st.config.FilterRegex)
-	var blockKeywords []string
-	if st.config.BlockRegex != "" {
-		for _, keyword := range strings.Split(st.config.BlockRegex, "|") {
-			keyword = strings.TrimSpace(keyword)
-			if keyword != "" {
-				blockKeywords = append(blockKeywords, strings.ToLower(keyword))
-			}
-		}
-	}
+	filteredProxies := allProxies
 
-	filteredProxies := make(map[string]*CProxy)
-	for name := range allProxies {
-		// 检查黑名单
-		shouldBlock := false
-		if len(blockKeywords) > 0 {
-			lowerName := strings.ToLower(name)
-			for _, keyword := range blockKeywords {
-				if strings.Contains(lowerName, keyword) {
-					shouldBlock = true
-					st.blockedNodes = append(st.blockedNodes, name)
-					st.blockedNodeCount++
-					break
-				}
-			}
-		}
-
-		if shouldBlock {
-			continue
+	// 只保留指定策略组中的节点
+	if st.config.Groups != "" {
+		var err error
+		filteredProxies, err = st.filterByGroups(filteredProxies, st.config.Groups)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		// 检查白名单（过滤正则）
-		if filterRegexp.MatchString(name) {
-			filteredProxies[name] = allProxies[name]
-		}
+	if st.config.DedupMode == DedupExitIP && !st.linting {
+		filteredProxies = st.dedupByExitIP(filteredProxies)
 	}
 
-	log.Infoln("Filtered to %d proxies (blocked: %d)", len(filteredProxies), st.blockedNodeCount)
+	log.Infoln("Filtered to %d proxies (blocked: %d, duplicates: %d)", len(filteredProxies), st.blockedNodeCount, st.duplicateCount)
 
 	// 如果没有加载到任何代理，返回错误
 	if len(filteredProxies) == 0 {
@@ -317,6 +453,22 @@ func (st *SpeedTester) LoadProxies(stashCompatible bool) (map[string]*CProxy, er
 	return filteredProxies, nil
 }
 
+// matchNodeFilters 检查节点名称是否满足 -f、-b 和筛选表达式，被 -b 屏蔽的节点记入 blockedNodes
+func (st *SpeedTester) matchNodeFilters(name string, proxy *CProxy) bool {
+	if st.config.BlockRegex != "" {
+		lowerName := strings.ToLower(name)
+		for _, keyword := range strings.Split(st.config.BlockRegex, "|") {
+			keyword = strings.ToLower(strings.TrimSpace(keyword))
+			if keyword != "" && strings.Contains(lowerName, keyword) {
+				st.blockedNodes = append(st.blockedNodes, name)
+				st.blockedNodeCount++
+				return false
+			}
+		}
+	}
+	return st.filterRegexp.MatchString(name) && st.nodeFilter.Match(proxyEnv{name: name, proxy: proxy})
+}
+
 func isStashCompatible(proxy *CProxy) bool {
 	switch proxy.Type() {
 	case constant.Shadowsocks:
@@ -404,7 +556,23 @@ func isStashCompatible(proxy *CProxy) bool {
 	return true
 }
 
+// TestProxiesContext 与 TestProxies 相同，ctx 取消后不再开始新节点的测试，已经开始的测试会完成，未测试的节点不回调
+func (st *SpeedTester) TestProxiesContext(ctx context.Context, proxies map[string]*CProxy, tester func(result *Result)) {
+	st.ctx = ctx
+	defer func() { st.ctx = nil }()
+	st.TestProxies(proxies, tester)
+}
+
+// stopped 表示 TestProxiesContext 的 ctx 已取消
+func (st *SpeedTester) stopped() bool {
+	return st.ctx != nil && st.ctx.Err() != nil
+}
+
 func (st *SpeedTester) TestProxies(proxies map[string]*CProxy, tester func(result *Result)) {
+	if !st.config.FastMode && st.config.StageTopK > 0 {
+		st.testStaged(proxies, tester)
+		return
+	}
 	if st.config.FastMode {
 		// 快速模式：并发测试
 		threadNum := st.config.Concurrent
@@ -423,8 +591,12 @@ func (st *SpeedTester) TestProxies(proxies map[string]*CProxy, tester func(resul
 				defer wg.Done()
 				semaphore <- struct{}{}        // 获取信号量（进入并发控制）
 				defer func() { <-semaphore }() // 释放信号量
+				if st.stopped() {
+					return
+				}
 
 				result := st.testProxy(n, p)
+				st.finishResult(result)
 				resultChan <- result
 			}(name, proxy)
 		}
@@ -443,36 +615,96 @@ func (st *SpeedTester) TestProxies(proxies map[string]*CProxy, tester func(resul
 	} else {
 		// 普通模式：串行测试
 		for name, proxy := range proxies {
+			if st.stopped() {
+				break
+			}
 			result := st.testProxy(name, proxy)
+			st.finishResult(result)
 			tester(result)
 		}
 	}
 
 }
 
+// finishResult 计算综合评分和相对直连基准的百分比，在筛选表达式或国家筛选用到出口国家时查询可用节点的出口国家
+func (st *SpeedTester) finishResult(result *Result) {
+	if result == nil {
+		return
+	}
+	result.Score = st.score(result)
+	st.normalize(result)
+	if result.Latency > 0 && st.needCountry() {
+		if location, err := st.GetIPLocation(result.Proxy); err == nil {
+			result.Country = location.CountryCode
+		}
+	}
+	if result.usage != nil {
+		result.BytesSent = result.usage.sent.Load()
+		result.BytesReceived = result.usage.received.Load()
+	}
+}
+
 type testJob struct {
 	name  string
 	proxy *CProxy
 }
 
 type Result struct {
-	ProxyName     string         `json:"proxy_name"`
-	ProxyType     string         `json:"proxy_type"`
-	ProxyConfig   map[string]any `json:"proxy_config"`
-	Proxy         constant.Proxy `json:"-"`
-	Latency       time.Duration  `json:"latency"`
-	Jitter        time.Duration  `json:"jitter"`
-	PacketLoss    float64        `json:"packet_loss"`
-	DownloadSize  float64        `json:"download_size"`
-	DownloadTime  time.Duration  `json:"download_time"`
-	DownloadSpeed float64        `json:"download_speed"`
-	UploadSize    float64        `json:"upload_size"`
-	UploadTime    time.Duration  `json:"upload_time"`
-	UploadSpeed   float64        `json:"upload_speed"`
+	ProxyName       string         `json:"proxy_name"`
+	ProxyType       string         `json:"proxy_type"`
+	ProxyConfig     map[string]any `json:"proxy_config"`
+	Source          string         `json:"source"`
+	Provider        string         `json:"provider,omitempty"`
+	Index           int            `json:"index"`
+	Fingerprint     string         `json:"fingerprint"`
+	Aliases         []string       `json:"aliases,omitempty"`
+	Sources         []string       `json:"sources,omitempty"`
+	Chain           []string       `json:"chain,omitempty"`
+	HopLatencies    []HopLatency   `json:"hop_latencies,omitempty"`
+	Country         string         `json:"country,omitempty"` // 出口 IP 所在国家代码，只在需要时查询
+	Score           float64        `json:"score"`             // 综合评分（0-100），见 ScoreWeights
+	Proxy           constant.Proxy `json:"-"`
+	Latency         time.Duration  `json:"latency"`
+	Jitter          time.Duration  `json:"jitter"`
+	PacketLoss      float64        `json:"packet_loss"`
+	UDPLatency      time.Duration  `json:"udp_latency,omitempty"`     // 经过节点到 UDPEcho 的平均往返延迟
+	UDPPacketLoss   float64        `json:"udp_packet_loss,omitempty"` // 经过节点到 UDPEcho 的丢包率，节点不支持 UDP 时为 100
+	DownloadSize    float64        `json:"download_size"`
+	DownloadTime    time.Duration  `json:"download_time"`
+	DownloadSpeed   float64        `json:"download_speed"`
+	UploadSize      float64        `json:"upload_size"`
+	UploadTime      time.Duration  `json:"upload_time"`
+	UploadSpeed     float64        `json:"upload_speed"`
+	UploadConfirmed bool           `json:"upload_confirmed,omitempty"` // 上传速度按测速服务器确认的字节数和接收时长计算
+	LatencyPercent  float64        `json:"latency_percent,omitempty"`  // 延迟占直连基准的百分比，见 Config.Normalize
+	DownloadPercent float64        `json:"download_percent,omitempty"` // 下载速度占直连基准的百分比
+	UploadPercent   float64        `json:"upload_percent,omitempty"`   // 上传速度占直连基准的百分比
+	// 原始 TCP 测速的结果，见 testStream。Intervals 为每个 StreamInterval 的速度，Speed 为去掉慢启动后的稳定速度
+	StreamDownloadSpeed     float64       `json:"stream_download_speed,omitempty"`
+	StreamDownloadIntervals []float64     `json:"stream_download_intervals,omitempty"`
+	StreamUploadSpeed       float64       `json:"stream_upload_speed,omitempty"`
+	StreamUploadIntervals   []float64     `json:"stream_upload_intervals,omitempty"`
+	Stage                   int           `json:"stage,omitempty"`            // 分阶段测试时节点通过的最后一个阶段，见 Stage*
+	ProbeSize               float64       `json:"probe_size,omitempty"`       // 第二阶段短测速的下载量
+	ProbeTime               time.Duration `json:"probe_time,omitempty"`       // 第二阶段短测速的用时
+	ProbeSpeed              float64       `json:"probe_speed,omitempty"`      // 第二阶段短测速的下载速度
+	BytesSent               int64         `json:"bytes_sent"`                 // 测试中经过节点发送的字节数，包括握手
+	BytesReceived           int64         `json:"bytes_received"`             // 测试中经过节点接收的字节数，包括握手
+	BudgetExceeded          bool          `json:"budget_exceeded,omitempty"`  // 流量预算不足，跳过了带宽测试
+	PayloadMismatch         bool          `json:"payload_mismatch,omitempty"` // 下载的内容与测速服务器生成的不一致，可能被篡改或截断
+	FailReason              string        `json:"fail_reason,omitempty"`      // 响应校验失败的原因，如重定向、HTML 页面、内容被截断，此类节点视为不可用
+
+	usage    *trafficCounter
+	upstream *CProxy // dialer-proxy 的上游节点，见 OutputProxies
+}
+
+// IsRelay 表示结果来自 relay 策略组，此类结果不能作为节点输出
+func (r *Result) IsRelay() bool {
+	return r.ProxyType == constant.Relay.String()
 }
 
 func (r *Result) FormatDownloadSpeed() string {
-	return formatSpeed(r.DownloadSpeed)
+	return FormatSpeed(r.DownloadSpeed)
 }
 
 func (r *Result) FormatLatency() string {
@@ -494,10 +726,20 @@ func (r *Result) FormatPacketLoss() string {
 }
 
 func (r *Result) FormatUploadSpeed() string {
-	return formatSpeed(r.UploadSpeed)
+	return FormatSpeed(r.UploadSpeed)
 }
 
-func formatSpeed(bytesPerSecond float64) string {
+// FormatTraffic 返回测试中经过节点收发的总流量
+func (r *Result) FormatTraffic() string {
+	return FormatBytes(r.BytesSent + r.BytesReceived)
+}
+
+func (r *Result) FormatScore() string {
+	return fmt.Sprintf("%.1f", r.Score)
+}
+
+// FormatSpeed 将字节每秒格式化为带单位的字符串
+func FormatSpeed(bytesPerSecond float64) string {
 	units := []string{"B/s", "KB/s", "MB/s", "GB/s", "TB/s"}
 	unit := 0
 	speed := bytesPerSecond
@@ -507,16 +749,29 @@ func formatSpeed(bytesPerSecond float64) string {
 	}
 	return fmt.Sprintf("%.2f%s", speed, units[unit])
 }
-func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
+
+// testConnectivity 请求一个小数据测试节点的连通性和延迟，链式节点同时测量每一跳的延迟
+func (st *SpeedTester) testConnectivity(name string, proxy *CProxy) *Result {
+	usage := &trafficCounter{}
+	metered := &meteredProxy{Proxy: proxy, usage: usage}
 	result := &Result{
 		ProxyName:   name,
 		ProxyType:   proxy.Type().String(),
 		ProxyConfig: proxy.Config,
-		Proxy:       proxy,
+		Source:      proxy.Source,
+		Provider:    proxy.Provider,
+		Index:       proxy.Index,
+		Fingerprint: proxy.Fingerprint,
+		Aliases:     proxy.Aliases,
+		Sources:     proxy.Sources,
+		Chain:       proxy.Chain,
+		Proxy:       metered,
+		usage:       usage,
+		upstream:    proxy.upstream,
 	}
 
 	// 尝试创建客户端并发起请求，任何错误都视为失败
-	client := st.createClient(proxy, st.config.MaxLatency)
+	client := st.createClient(metered, st.config.MaxLatency)
 	// 快速连接测试 - 直接请求一个小数据
 	url := fmt.Sprintf("%s/__down?bytes=0", st.config.ServerURL)
 	if st.config.FastMode {
@@ -530,31 +785,63 @@ func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
 		// 连接失败，返回全零结果
 		return result
 	}
+	latency := time.Since(start)
+	//fmt.Printf("\n %s %s %d", name, url, resp.StatusCode)
+	// 状态码不在白名单、重定向或返回 HTML 页面时视为失败
+	checkErr := st.checkProbeResponse(resp)
 	err = resp.Body.Close()
 	if err != nil {
 		return nil
 	}
-	//fmt.Printf("\n %s %s %d", name, url, resp.StatusCode)
-	//5xx代码返回失败
-	if resp.StatusCode/100 == 5 {
-		// HTTP 状态码异常，返回全零结果
+	if checkErr != nil {
+		result.fail(checkErr)
 		return result
 	}
 	// 记录基本延迟
-	result.Latency = time.Since(start)
+	result.Latency = latency
+	// 链式节点逐跳测量延迟
+	if len(proxy.hops) > 1 {
+		result.HopLatencies = st.testHopLatencies(proxy, usage, url, result.Latency)
+	}
+	// 在同一个连接上连续测量延迟得到抖动和丢包率
+	if st.config.PingCount > 0 {
+		if stats := st.testJitter(metered); stats != nil {
+			result.Jitter = stats.jitter
+			result.PacketLoss = stats.packetLoss
+		}
+	}
+	if st.config.UDPEcho != "" {
+		result.UDPLatency, result.UDPPacketLoss = st.testUDP(metered)
+	}
+	return result
+}
+
+// testProxy 测试节点的连通性，非快速模式下延迟未超限时再测试下载和上传速度
+func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
+	result := st.testConnectivity(name, proxy)
 	// FastMode 下只测试连通性就返回
-	if st.config.FastMode {
+	if result == nil || st.config.FastMode {
 		return result
 	}
 	// 检查延迟是否超限
-	if result.Latency > st.config.MaxLatency {
+	if result.Latency == 0 || result.Latency > st.config.MaxLatency {
 		return result
 	}
+	st.testThroughput(result.Proxy, result)
+	return result
+}
+
+// testThroughput 并发测试节点的下载和上传速度，结果写入 result
+func (st *SpeedTester) testThroughput(proxy constant.Proxy, result *Result) {
+	if !st.withinBudget(int64(st.config.DownloadSize + st.config.UploadSize)) {
+		result.BudgetExceeded = true
+		return
+	}
 	// 2. 并发进行下载测试
 	var wg sync.WaitGroup
 	var totalDownloadBytes, totalUploadBytes int64
 	var totalDownloadTime, totalUploadTime time.Duration
-	var downloadCount, uploadCount int
+	var downloadCount, uploadCount, confirmedCount int
 	downloadChunkSize := st.config.DownloadSize / st.config.Concurrent
 	if downloadChunkSize > 0 {
 		downloadResults := make(chan *downloadResult, st.config.Concurrent)
@@ -567,7 +854,9 @@ func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
 		}
 		wg.Wait()
 		for range st.config.Concurrent {
-			if dr := <-downloadResults; dr != nil {
+			if dr := <-downloadResults; dr != nil && dr.err != nil {
+				result.fail(dr.err)
+			} else if dr != nil {
 				totalDownloadBytes += dr.bytes
 				totalDownloadTime += dr.duration
 				downloadCount++
@@ -581,7 +870,7 @@ func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
 		}
 		// 下载速度不达标，返回（此时已有部分数据）
 		if result.DownloadSpeed < st.config.MinDownloadSpeed {
-			return result
+			return
 		}
 	}
 	// 3. 并发进行上传测试
@@ -597,7 +886,12 @@ func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
 		}
 		wg.Wait()
 		for i := 0; i < st.config.Concurrent; i++ {
-			if ur := <-uploadResults; ur != nil {
+			if ur := <-uploadResults; ur != nil && ur.err != nil {
+				result.fail(ur.err)
+			} else if ur != nil {
+				if ur.confirmed {
+					confirmedCount++
+				}
 				totalUploadBytes += ur.bytes
 				totalUploadTime += ur.duration
 				uploadCount++
@@ -605,12 +899,30 @@ func (st *SpeedTester) testProxy(name string, proxy *CProxy) *Result {
 		}
 		close(uploadResults)
 		if uploadCount > 0 {
+			result.UploadConfirmed = confirmedCount == uploadCount
 			result.UploadSize = float64(totalUploadBytes)
 			result.UploadTime = totalUploadTime / time.Duration(uploadCount)
 			result.UploadSpeed = float64(totalUploadBytes) / result.UploadTime.Seconds()
 		}
 	}
-	return result
+	// 4. 原始 TCP 测速，下载和上传依次进行，按测得的速度预估流量，预算不足时跳过
+	if st.config.StreamServer != "" && st.withinBudget(st.streamTrafficEstimate(result)) {
+		for _, direction := range []string{StreamDown, StreamUp} {
+			sr, err := st.testStream(proxy, direction)
+			if err != nil {
+				result.fail(err)
+				return
+			}
+			if sr == nil {
+				continue
+			}
+			if direction == StreamDown {
+				result.StreamDownloadSpeed, result.StreamDownloadIntervals = sr.steady, sr.intervals
+			} else {
+				result.StreamUploadSpeed, result.StreamUploadIntervals = sr.steady, sr.intervals
+			}
+		}
+	}
 }
 
 type latencyResult struct {
@@ -651,25 +963,39 @@ func (st *SpeedTester) testLatency(proxy constant.Proxy, timeout time.Duration)
 }
 
 type downloadResult struct {
-	bytes    int64
-	duration time.Duration
+	bytes     int64
+	duration  time.Duration
+	err       error // 响应校验失败的原因
+	confirmed bool  // 上传的字节数或时长来自测速服务器的确认
 }
 
 func (st *SpeedTester) testDownload(proxy constant.Proxy, size int, timeout time.Duration) *downloadResult {
 	client := st.createClient(proxy, timeout)
+	url := fmt.Sprintf("%s/__down?bytes=%d", st.config.ServerURL, size)
+	var seed *uint64
+	if st.config.Payload == PayloadRandom {
+		// 每次使用不同的 seed，避免中间节点缓存
+		s := rand.Uint64()
+		seed = &s
+		url += fmt.Sprintf("&seed=%d", s)
+	}
 	start := time.Now()
 
-	resp, err := client.Get(fmt.Sprintf("%s/__down?bytes=%d", st.config.ServerURL, size))
+	resp, err := client.Get(url)
 	if err != nil {
 		return nil
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	if err := checkStatus(resp, []int{http.StatusOK}); err != nil {
+		return &downloadResult{err: err}
 	}
 
-	downloadBytes, _ := io.Copy(io.Discard, resp.Body)
+	downloadBytes, err := st.readPayload(resp, size, seed)
+	if err != nil {
+		log.Warnln("Invalid download response from %s: %v", proxy.Name(), err)
+		return &downloadResult{err: err}
+	}
 
 	return &downloadResult{
 		bytes:    downloadBytes,
@@ -679,7 +1005,7 @@ func (st *SpeedTester) testDownload(proxy constant.Proxy, size int, timeout time
 
 func (st *SpeedTester) testUpload(proxy constant.Proxy, size int, timeout time.Duration) *downloadResult {
 	client := st.createClient(proxy, timeout)
-	reader := NewZeroReader(size)
+	reader := NewRandomReader(size, rand.Uint64())
 
 	start := time.Now()
 	resp, err := client.Post(
@@ -692,41 +1018,87 @@ func (st *SpeedTester) testUpload(proxy constant.Proxy, size int, timeout time.D
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil
+	if err := checkStatus(resp, []int{http.StatusOK}); err != nil {
+		return &downloadResult{err: err}
 	}
+	duration := time.Since(start)
 
+	// 本地计时包括数据进入本地缓冲区的时间，测速服务器支持时优先使用服务器确认的字节数和接收时长
+	if bytes, serverDuration, ok := readUploadReceipt(resp); ok {
+		if bytes < 0 {
+			bytes = reader.WrittenBytes()
+		}
+		return &downloadResult{
+			bytes:     bytes,
+			duration:  serverDuration,
+			confirmed: true,
+		}
+	}
 	return &downloadResult{
 		bytes:    reader.WrittenBytes(),
-		duration: time.Since(start),
+		duration: duration,
 	}
 }
 
 func (st *SpeedTester) createClient(proxy constant.Proxy, timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		DialContext: st.dialContext(proxy),
+	}
+	var roundTripper http.RoundTripper = transport
+	if st.config.ServerToken != "" {
+		roundTripper = &serverAuthTransport{RoundTripper: transport, serverURL: st.config.ServerURL, token: st.config.ServerToken}
+	}
 	return &http.Client{
 		Timeout: timeout,
-		Transport: &http.Transport{
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				var u16Port uint16
-				if port, err := strconv.ParseUint(port, 10, 16); err == nil {
-					u16Port = uint16(port)
-				}
-				return proxy.DialContext(ctx, &constant.Metadata{
-					Host:    host,
-					DstPort: u16Port,
-				})
-			},
+		// 不跟随重定向，测速服务器不会返回重定向，重定向由 checkStatus 视为失败
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
 		},
+		Transport: roundTripper,
 	}
 }
 
+// dialContext 返回通过 proxy 建立 TCP 连接的拨号函数，连接的流量计入统计
+func (st *SpeedTester) dialContext(proxy constant.Proxy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var u16Port uint16
+		if port, err := strconv.ParseUint(port, 10, 16); err == nil {
+			u16Port = uint16(port)
+		}
+		conn, err := proxy.DialContext(ctx, &constant.Metadata{
+			Host:    host,
+			DstPort: u16Port,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return st.meter(proxy, conn), nil
+	}
+}
+
+// serverAuthTransport 为发往测速服务器的请求添加 Authorization: Bearer <token>，其他请求（如查询出口 IP）不添加
+type serverAuthTransport struct {
+	http.RoundTripper
+	serverURL string
+	token     string
+}
+
+func (t *serverAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if server, err := url.Parse(t.serverURL); err == nil && req.URL.Host == server.Host {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
 func calculateLatencyStats(latencies []time.Duration, failedPings int) *latencyResult {
-	result := &latencyResult{
-		packetLoss: float64(failedPings) / 6.0 * 100,
+	result := &latencyResult{}
+	if total := len(latencies) + failedPings; total > 0 {
+		result.packetLoss = float64(failedPings) / float64(total) * 100
 	}
 
 	if len(latencies) == 0 {
@@ -764,13 +1136,18 @@ func convertMappedIPv6ToIPv4(server string) string {
 }
 
 type IPLocation struct {
+	IP          string `json:"query"`
 	Country     string `json:"country"`
 	CountryCode string `json:"countryCode"`
 }
 
 func (st *SpeedTester) GetIPLocation(proxy constant.Proxy) (*IPLocation, error) {
-	client := st.createClient(proxy, 10*time.Second)
-	resp, err := client.Get("http://ip-api.com/json?fields=country,countryCode")
+	return st.getIPLocation(proxy, 10*time.Second)
+}
+
+func (st *SpeedTester) getIPLocation(proxy constant.Proxy, timeout time.Duration) (*IPLocation, error) {
+	client := st.createClient(proxy, timeout)
+	resp, err := client.Get("http://ip-api.com/json?fields=query,country,countryCode")
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,256 @@
+package speedtester
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/metacubex/mihomo/constant"
+	"github.com/metacubex/mihomo/log"
+)
+
+// StreamMagic 是原始 TCP 测速协议的标识和版本
+const StreamMagic = "CST-STREAM/2"
+
+// 原始 TCP 测速的方向，以客户端为准
+const (
+	StreamDown = "down" // 服务器持续发送
+	StreamUp   = "up"   // 客户端持续发送
+)
+
+// StreamInterval 是原始 TCP 测速统计吞吐量的区间长度
+const StreamInterval = 500 * time.Millisecond
+
+// streamGrace 是测速时长结束后等待剩余数据或服务器统计的时间
+const streamGrace = 2 * time.Second
+
+// StreamRequest 是原始 TCP 测速的请求头。连接建立后服务器先发送一行挑战
+//
+//	CST-STREAM/2 <nonce>
+//
+// 客户端回复一行
+//
+//	CST-STREAM/2 <down|up> <时长毫秒> <MAC，没有 token 时为 ->
+//
+// 其中 MAC 见 StreamMAC。测速经过的节点大多不可信，token 本身不会在连接上发送。
+// 服务器回复 OK 或 ERR <原因>，随后按方向持续发送或接收 Duration。
+// 上传结束后服务器再返回一行 JSON 格式的 StreamReport
+type StreamRequest struct {
+	Direction string
+	Duration  time.Duration
+	MAC       string
+}
+
+func (r *StreamRequest) String() string {
+	mac := r.MAC
+	if mac == "" {
+		mac = "-"
+	}
+	return fmt.Sprintf("%s %s %d %s\n", StreamMagic, r.Direction, r.Duration.Milliseconds(), mac)
+}
+
+// StreamMAC 用 token 对服务器的 nonce 和请求内容计算 HMAC-SHA256，token 为空时返回空字符串
+func StreamMAC(token, nonce, direction string, duration time.Duration) string {
+	if token == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%s %s %s %d", StreamMagic, nonce, direction, duration.Milliseconds())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify 检查请求的 MAC 是否由 token 对 nonce 计算得到，token 为空时不检查
+func (r *StreamRequest) Verify(token, nonce string) bool {
+	if token == "" {
+		return true
+	}
+	return hmac.Equal([]byte(r.MAC), []byte(StreamMAC(token, nonce, r.Direction, r.Duration)))
+}
+
+// NewStreamChallenge 生成服务器发送的挑战和其中的 nonce
+func NewStreamChallenge() (challenge string, nonce string) {
+	var b [16]byte
+	crand.Read(b[:])
+	nonce = hex.EncodeToString(b[:])
+	return fmt.Sprintf("%s %s\n", StreamMagic, nonce), nonce
+}
+
+// parseStreamChallenge 从服务器的挑战中读取 nonce
+func parseStreamChallenge(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != StreamMagic {
+		return "", errors.New("invalid stream challenge")
+	}
+	return fields[1], nil
+}
+
+// ParseStreamRequest 解析 StreamRequest.String 生成的请求头
+func ParseStreamRequest(line string) (*StreamRequest, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != StreamMagic {
+		return nil, errors.New("invalid stream request")
+	}
+	if fields[1] != StreamDown && fields[1] != StreamUp {
+		return nil, fmt.Errorf("invalid direction %q", fields[1])
+	}
+	ms, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || ms <= 0 {
+		return nil, fmt.Errorf("invalid duration %q", fields[2])
+	}
+	request := &StreamRequest{Direction: fields[1], Duration: time.Duration(ms) * time.Millisecond}
+	if fields[3] != "-" {
+		request.MAC = fields[3]
+	}
+	return request, nil
+}
+
+// StreamReport 是上传测速结束后服务器返回的接收统计
+type StreamReport struct {
+	Bytes      int64   `json:"bytes"`       // 服务器收到的字节数
+	DurationMs float64 `json:"duration_ms"` // 服务器接收的时长
+	Intervals  []int64 `json:"intervals"`   // 每个 StreamInterval 收到的字节数
+}
+
+// StreamIntervals 返回 duration 包含的完整统计区间数，至少为 1
+func StreamIntervals(duration time.Duration) int {
+	return max(int(duration/StreamInterval), 1)
+}
+
+// streamResult 是一个方向的原始 TCP 测速结果
+type streamResult struct {
+	intervals []float64 // 每个区间的速度（字节/秒）
+	steady    float64   // 稳定阶段的速度，见 steadySpeed
+}
+
+// testStream 不经过 http.Client，通过节点直接连接 StreamServer（download-server -stream），
+// 按 direction 持续收发 StreamDuration，统计每个区间的吞吐量。
+// 连接失败或服务器拒绝时返回 nil，服务器的回复不符合协议时返回错误
+func (st *SpeedTester) testStream(proxy constant.Proxy, direction string) (*streamResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), st.config.Timeout)
+	defer cancel()
+	conn, err := st.dialContext(proxy)(ctx, "tcp", st.config.StreamServer)
+	if err != nil {
+		return nil, nil
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(st.config.Timeout))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, nil
+	}
+	nonce, err := parseStreamChallenge(line)
+	if err != nil {
+		return nil, err
+	}
+	request := &StreamRequest{Direction: direction, Duration: st.config.StreamDuration}
+	request.MAC = StreamMAC(st.config.ServerToken, nonce, request.Direction, request.Duration)
+	if _, err := io.WriteString(conn, request.String()); err != nil {
+		return nil, nil
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return nil, nil
+	}
+	switch {
+	case line == "OK\n":
+	case strings.HasPrefix(line, "ERR "):
+		log.Warnln("Stream server rejected %s: %s", proxy.Name(), strings.TrimSpace(strings.TrimPrefix(line, "ERR ")))
+		return nil, nil
+	default:
+		return nil, errors.New("invalid stream response")
+	}
+	conn.SetDeadline(time.Time{})
+
+	var counts []int64
+	if direction == StreamDown {
+		counts = readStream(conn, reader, request.Duration)
+	} else {
+		counts = writeStream(conn, reader, request.Duration)
+	}
+	intervals := make([]float64, len(counts))
+	var total int64
+	for i, n := range counts {
+		intervals[i] = float64(n) / StreamInterval.Seconds()
+		total += n
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	return &streamResult{intervals: intervals, steady: steadySpeed(intervals)}, nil
+}
+
+// readStream 接收服务器发送的数据，返回每个区间收到的字节数。
+// 提前结束（如达到服务器的 -max-bytes）时只保留结束前完整的区间
+func readStream(conn net.Conn, reader io.Reader, duration time.Duration) []int64 {
+	counts := make([]int64, StreamIntervals(duration))
+	buf := make([]byte, 32*1024)
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(duration + streamGrace))
+	for {
+		n, err := reader.Read(buf)
+		if i := int(time.Since(start) / StreamInterval); i < len(counts) {
+			counts[i] += int64(n)
+		}
+		if err != nil {
+			return counts[:min(len(counts), StreamIntervals(time.Since(start)))]
+		}
+	}
+}
+
+// writeStream 持续发送不可压缩的数据，返回每个区间服务器确认收到的字节数。
+// 服务器没有返回统计时使用本地写出的字节数
+func writeStream(conn net.Conn, reader *bufio.Reader, duration time.Duration) []int64 {
+	counts := make([]int64, StreamIntervals(duration))
+	payload := NewRandomReader(math.MaxInt, rand.Uint64())
+	buf := make([]byte, 32*1024)
+	start := time.Now()
+	conn.SetWriteDeadline(start.Add(duration))
+	for time.Since(start) < duration {
+		payload.Read(buf)
+		n, err := conn.Write(buf)
+		if i := int(time.Since(start) / StreamInterval); i < len(counts) {
+			counts[i] += int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	counts = counts[:min(len(counts), StreamIntervals(time.Since(start)))]
+
+	conn.SetReadDeadline(time.Now().Add(streamGrace))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return counts
+	}
+	var report StreamReport
+	if err := json.Unmarshal(line, &report); err != nil || len(report.Intervals) == 0 {
+		return counts
+	}
+	return report.Intervals[:min(len(report.Intervals), len(counts))]
+}
+
+// steadySpeed 返回稳定阶段的速度：前 1/5 的区间（至少一个）视为 TCP 慢启动不参与计算，
+// 其余区间取中位数，个别因丢包重传而停顿的区间不影响结果
+func steadySpeed(intervals []float64) float64 {
+	if len(intervals) <= 1 {
+		return median(intervals)
+	}
+	skip := max(len(intervals)/5, 1)
+	return median(intervals[skip:])
+}
@@ -0,0 +1,173 @@
+package speedtester
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 订阅即将到期或流量即将用完时给出提醒的阈值
+const (
+	subscriptionExpireWarning    = 7 * 24 * time.Hour
+	subscriptionRemainingWarning = 0.1 // 剩余流量占总流量的比例
+)
+
+// SubscriptionInfo 表示订阅响应头 subscription-userinfo 和 profile-update-interval 中的流量和到期信息
+type SubscriptionInfo struct {
+	Source         string        `json:"source"`             // 配置来源，已去掉凭据和查询参数
+	Provider       string        `json:"provider,omitempty"` // provider 名称，配置本身的订阅为空
+	Upload         int64         `json:"upload"`
+	Download       int64         `json:"download"`
+	Total          int64         `json:"total"`                     // 总流量，0 表示未知或不限
+	Expire         time.Time     `json:"expire,omitzero"`           // 到期时间，零值表示长期有效
+	UpdateInterval time.Duration `json:"update_interval,omitempty"` // 建议的订阅更新间隔
+}
+
+// parseSubscriptionInfo 解析响应头，没有 subscription-userinfo 时返回 nil
+func parseSubscriptionInfo(header http.Header) *SubscriptionInfo {
+	userInfo := header.Get("Subscription-Userinfo")
+	if userInfo == "" {
+		return nil
+	}
+
+	info := &SubscriptionInfo{}
+	for _, field := range strings.Split(userInfo, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		// 部分机场返回浮点数或科学计数法
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			info.Upload = int64(number)
+		case "download":
+			info.Download = int64(number)
+		case "total":
+			info.Total = int64(number)
+		case "expire":
+			if number > 0 {
+				info.Expire = time.Unix(int64(number), 0)
+			}
+		}
+	}
+
+	if hours, err := strconv.ParseFloat(strings.TrimSpace(header.Get("Profile-Update-Interval")), 64); err == nil && hours > 0 {
+		info.UpdateInterval = time.Duration(hours * float64(time.Hour))
+	}
+	return info
+}
+
+// Used 返回已用流量
+func (info *SubscriptionInfo) Used() int64 {
+	return info.Upload + info.Download
+}
+
+// Remaining 返回剩余流量，总流量未知时返回 -1
+func (info *SubscriptionInfo) Remaining() int64 {
+	if info.Total <= 0 {
+		return -1
+	}
+	return max(info.Total-info.Used(), 0)
+}
+
+// Warnings 返回订阅已到期、即将到期或流量即将用完的提醒
+func (info *SubscriptionInfo) Warnings(now time.Time) []string {
+	var warnings []string
+	if !info.Expire.IsZero() {
+		if left := info.Expire.Sub(now); left <= 0 {
+			warnings = append(warnings, fmt.Sprintf("subscription expired at %s", info.Expire.Format(time.DateOnly)))
+		} else if left < subscriptionExpireWarning {
+			warnings = append(warnings, fmt.Sprintf("subscription expires in %d days (%s)", int(left.Hours()/24), info.Expire.Format(time.DateOnly)))
+		}
+	}
+	if remaining := info.Remaining(); remaining == 0 {
+		warnings = append(warnings, "subscription traffic is used up")
+	} else if remaining > 0 && float64(remaining) < float64(info.Total)*subscriptionRemainingWarning {
+		warnings = append(warnings, fmt.Sprintf("subscription traffic left %s of %s", FormatBytes(remaining), FormatBytes(info.Total)))
+	}
+	return warnings
+}
+
+// HeaderValue 返回 subscription-userinfo 格式的字符串
+func (info *SubscriptionInfo) HeaderValue() string {
+	var expire int64
+	if !info.Expire.IsZero() {
+		expire = info.Expire.Unix()
+	}
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", info.Upload, info.Download, info.Total, expire)
+}
+
+// MergeSubscriptionInfo 合并多个订阅的流量，到期时间取最早的一个，用于向客户端返回单个 subscription-userinfo。
+// 任一订阅的总流量为 0（未知或不限）时，合并后的总流量也为 0
+func MergeSubscriptionInfo(infos []*SubscriptionInfo) *SubscriptionInfo {
+	if len(infos) == 0 {
+		return nil
+	}
+	merged := &SubscriptionInfo{}
+	unlimited := false
+	for _, info := range infos {
+		merged.Upload += info.Upload
+		merged.Download += info.Download
+		merged.Total += info.Total
+		if info.Total <= 0 {
+			unlimited = true
+		}
+		if !info.Expire.IsZero() && (merged.Expire.IsZero() || info.Expire.Before(merged.Expire)) {
+			merged.Expire = info.Expire
+		}
+		if info.UpdateInterval > 0 && (merged.UpdateInterval == 0 || info.UpdateInterval < merged.UpdateInterval) {
+			merged.UpdateInterval = info.UpdateInterval
+		}
+	}
+	if unlimited {
+		merged.Total = 0
+	}
+	return merged
+}
+
+// Subscriptions 返回最近一次 LoadProxies 获取到的订阅流量信息
+func (st *SpeedTester) Subscriptions() []*SubscriptionInfo {
+	return st.subscriptions
+}
+
+// recordSubscription 记录订阅响应头中的流量信息
+func (st *SpeedTester) recordSubscription(source string, provider string, header http.Header) {
+	info := parseSubscriptionInfo(header)
+	if info == nil {
+		return
+	}
+	info.Source = RedactSource(source)
+	info.Provider = provider
+	st.subscriptions = append(st.subscriptions, info)
+}
+
+// RedactSource 去掉订阅地址中的凭据和查询参数，避免在输出中泄露 token
+func RedactSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// FormatBytes 将字节数格式化为带单位的字符串
+func FormatBytes(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	unit := 0
+	size := float64(bytes)
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f%s", size, units[unit])
+}
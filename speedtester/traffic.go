@@ -0,0 +1,164 @@
+package speedtester
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/metacubex/mihomo/constant"
+)
+
+// latencyTrafficEstimate 一次连通性测试（含 TLS 握手）大约消耗的流量，用于预估
+const latencyTrafficEstimate = 16 * 1024
+
+// streamRateEstimate 没有测得的速度时，按 100Mbps 预估原始 TCP 测速每个方向的速度
+const streamRateEstimate = 100 * 1000 * 1000 / 8
+
+// trafficCounter 记录收发的字节数
+type trafficCounter struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// countingConn 统计经过连接的字节数，同时计入节点和本次测试的总量
+type countingConn struct {
+	net.Conn
+	counters []*trafficCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, counter := range c.counters {
+		counter.received.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	for _, counter := range c.counters {
+		counter.sent.Add(int64(n))
+	}
+	return n, err
+}
+
+// countingPacketConn 统计经过 UDP 连接的字节数，同时计入节点和本次测试的总量
+type countingPacketConn struct {
+	net.PacketConn
+	counters []*trafficCounter
+}
+
+func (c *countingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	for _, counter := range c.counters {
+		counter.received.Add(int64(n))
+	}
+	return n, addr, err
+}
+
+func (c *countingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	for _, counter := range c.counters {
+		counter.sent.Add(int64(n))
+	}
+	return n, err
+}
+
+// meteredProxy 将经过代理的流量计入 usage，用于统计单个节点的流量
+type meteredProxy struct {
+	constant.Proxy
+	usage *trafficCounter
+}
+
+// meter 包装通过 proxy 建立的连接，统计其收发的字节数
+func (st *SpeedTester) meter(proxy constant.Proxy, conn net.Conn) net.Conn {
+	return &countingConn{Conn: conn, counters: st.trafficCounters(proxy)}
+}
+
+// meterPacket 包装通过 proxy 建立的 UDP 连接，统计其收发的字节数
+func (st *SpeedTester) meterPacket(proxy constant.Proxy, pc net.PacketConn) net.PacketConn {
+	return &countingPacketConn{PacketConn: pc, counters: st.trafficCounters(proxy)}
+}
+
+// trafficCounters 返回经过 proxy 的流量需要计入的计数器
+func (st *SpeedTester) trafficCounters(proxy constant.Proxy) []*trafficCounter {
+	counters := []*trafficCounter{&st.traffic}
+	if m, ok := proxy.(*meteredProxy); ok {
+		counters = append(counters, m.usage)
+	}
+	return counters
+}
+
+// TrafficUsed 返回自上次 LoadProxies 以来经过代理发送和接收的字节数，包括去重时查询出口 IP 的流量
+func (st *SpeedTester) TrafficUsed() (sent, received int64) {
+	return st.traffic.sent.Load(), st.traffic.received.Load()
+}
+
+// withinBudget 判断剩余的流量预算是否足够再消耗 size 字节
+func (st *SpeedTester) withinBudget(size int64) bool {
+	if st.config.TrafficBudget <= 0 {
+		return true
+	}
+	sent, received := st.TrafficUsed()
+	return sent+received+size <= st.config.TrafficBudget
+}
+
+// EstimateTraffic 预估测试 count 个节点最多消耗的流量，假设所有节点都通过延迟测试
+func (st *SpeedTester) EstimateTraffic(count int) int64 {
+	n := int64(count)
+	total := n * latencyTrafficEstimate
+	if st.config.FastMode {
+		return total
+	}
+	full := int64(st.config.DownloadSize+st.config.UploadSize) + st.streamTrafficEstimate(nil)
+	if st.config.StageTopK > 0 {
+		return total + n*int64(st.config.ProbeSize) + int64(min(count, st.config.StageTopK))*full
+	}
+	return total + n*full
+}
+
+// streamTrafficEstimate 预估原始 TCP 测速消耗的流量：两个方向各持续 StreamDuration，
+// 速度使用 result 中已测得的下载和上传速度，没有时按 streamRateEstimate
+func (st *SpeedTester) streamTrafficEstimate(result *Result) int64 {
+	if st.config.StreamServer == "" {
+		return 0
+	}
+	down, up := float64(streamRateEstimate), float64(streamRateEstimate)
+	if result != nil && result.DownloadSpeed > 0 {
+		down, up = result.DownloadSpeed, result.DownloadSpeed
+	}
+	if result != nil && result.UploadSpeed > 0 {
+		up = result.UploadSpeed
+	}
+	return int64((down + up) * st.config.StreamDuration.Seconds())
+}
+
+// ParseBytes 解析 500MB、2GB、1.5G 形式的流量，不带单位时按字节
+func ParseBytes(s string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"TB", 1 << 40}, {"T", 1 << 40},
+		{"GB", 1 << 30}, {"G", 1 << 30},
+		{"MB", 1 << 20}, {"M", 1 << 20},
+		{"KB", 1 << 10}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	scale := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * scale), nil
+}
@@ -0,0 +1,59 @@
+package speedtester
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UploadReceipt 是 download-server 的 /__up 返回的确认信息
+type UploadReceipt struct {
+	Bytes      int64   `json:"bytes"`       // 服务器收到的字节数
+	DurationMs float64 `json:"duration_ms"` // 服务器从收到请求头到读完请求体的时长
+}
+
+// 上传确认在 Server-Timing 中的名称，recv 来自 download-server，cfRequestDuration 来自 Cloudflare
+var uploadTimingNames = []string{"recv", "cfRequestDuration"}
+
+// readUploadReceipt 从 /__up 的响应中读取服务器确认的字节数和接收时长。
+// JSON 响应体同时提供两者；只有 Server-Timing 时字节数为 -1，由调用方使用本地写出的字节数
+func readUploadReceipt(resp *http.Response) (bytes int64, duration time.Duration, ok bool) {
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		var receipt UploadReceipt
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&receipt); err == nil && receipt.DurationMs > 0 {
+			return receipt.Bytes, time.Duration(receipt.DurationMs * float64(time.Millisecond)), true
+		}
+	}
+	timings := parseServerTiming(resp.Header.Values("Server-Timing"))
+	for _, name := range uploadTimingNames {
+		if d, ok := timings[name]; ok && d > 0 {
+			return -1, d, true
+		}
+	}
+	return 0, 0, false
+}
+
+// parseServerTiming 解析 Server-Timing 响应头中各项的 dur（毫秒）
+func parseServerTiming(values []string) map[string]time.Duration {
+	timings := make(map[string]time.Duration)
+	for _, value := range values {
+		for _, metric := range strings.Split(value, ",") {
+			params := strings.Split(metric, ";")
+			name := strings.TrimSpace(params[0])
+			for _, param := range params[1:] {
+				k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if !strings.EqualFold(k, "dur") {
+					continue
+				}
+				if ms, err := strconv.ParseFloat(strings.Trim(v, `"`), 64); err == nil {
+					timings[name] = time.Duration(ms * float64(time.Millisecond))
+				}
+			}
+		}
+	}
+	return timings
+}
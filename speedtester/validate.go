@@ -0,0 +1,101 @@
+package speedtester
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// DefaultAcceptStatus 是延迟测试默认接受的状态码
+var DefaultAcceptStatus = []int{http.StatusOK, http.StatusNoContent}
+
+var errPayloadMismatch = errors.New("payload mismatch")
+
+// sniffSize 检查响应是否为 HTML 时读取的字节数，与 http.DetectContentType 一致
+const sniffSize = 512
+
+// checkStatus 检查响应的状态码，重定向通常来自认证页面（captive portal）或运营商劫持
+func checkStatus(resp *http.Response, accept []int) error {
+	if resp.StatusCode/100 == 3 {
+		return fmt.Errorf("redirected to %s", resp.Header.Get("Location"))
+	}
+	if !slices.Contains(accept, resp.StatusCode) {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkProbeResponse 检查延迟测试的响应，测速服务器返回空内容，HTML 页面说明请求被拦截
+func (st *SpeedTester) checkProbeResponse(resp *http.Response) error {
+	accept := st.config.AcceptStatus
+	if len(accept) == 0 {
+		accept = DefaultAcceptStatus
+	}
+	if err := checkStatus(resp, accept); err != nil {
+		return err
+	}
+	head, _ := bufio.NewReaderSize(resp.Body, sniffSize).Peek(sniffSize)
+	if isHTML(resp.Header.Get("Content-Type"), head) {
+		return errors.New("unexpected html response")
+	}
+	return nil
+}
+
+// isHTML 根据 Content-Type 和内容开头判断响应是否为 HTML 页面
+func isHTML(contentType string, head []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "text/html" {
+		return true
+	}
+	return len(head) > 0 && strings.HasPrefix(http.DetectContentType(head), "text/html")
+}
+
+// readPayload 读取下载测试的响应，返回收到的字节数。
+// 在超时前正常读完的响应必须恰好是 size 字节，不能是 HTML 页面，开启 VerifyPayload 时内容还必须与 seed 对应的数据一致；
+// 超时中断的下载不视为异常，已收到的字节照常计入速度
+func (st *SpeedTester) readPayload(resp *http.Response, size int, seed *uint64) (int64, error) {
+	body := bufio.NewReaderSize(resp.Body, sniffSize)
+	head, _ := body.Peek(sniffSize)
+	if isHTML(resp.Header.Get("Content-Type"), head) {
+		return 0, errors.New("unexpected html response")
+	}
+
+	var w io.Writer = io.Discard
+	var verifier *PayloadVerifier
+	if st.config.VerifyPayload {
+		verifier = NewPayloadVerifier(seed)
+		w = verifier
+	}
+	n, err := io.Copy(w, body)
+	if verifier != nil && verifier.Err() != nil {
+		return n, fmt.Errorf("%w: %v", errPayloadMismatch, verifier.Err())
+	}
+	switch {
+	case err != nil && !isTimeout(err):
+		return n, fmt.Errorf("truncated after %d bytes: %v", n, err)
+	case err == nil && n != int64(size):
+		return n, fmt.Errorf("received %d of %d bytes", n, size)
+	}
+	return n, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// fail 记录节点未通过响应校验的原因，只保留第一个原因
+func (r *Result) fail(err error) {
+	if r.FailReason == "" {
+		r.FailReason = err.Error()
+	}
+	if errors.Is(err, errPayloadMismatch) {
+		r.PayloadMismatch = true
+	}
+}
@@ -0,0 +1,90 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/faceair/clash-speedtest/history"
+)
+
+// nodeHistory 表示单个节点的历史查询结果
+type nodeHistory struct {
+	Stats   *history.NodeStats `json:"stats"`
+	Records []*history.Record  `json:"records"`
+}
+
+// handleHistory 按节点 ID 或名称查询历史记录
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.validateAuth(r.Header.Get("Authorization")) {
+		http.Error(w, "未授权：无效的 Authorization header", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query().Get("node")
+	if query == "" {
+		http.Error(w, "缺少 node 参数", http.StatusBadRequest)
+		return
+	}
+	window := s.config.HistoryWindow
+	if v := r.URL.Query().Get("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "无效的 window 参数", http.StatusBadRequest)
+			return
+		}
+		window = n
+	}
+
+	nodes, err := s.config.History.FindNodes(query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("查询历史失败: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]*nodeHistory, 0, len(nodes))
+	for _, node := range nodes {
+		stats, err := s.config.History.Stats(node.NodeID, window)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询历史失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		records, err := s.config.History.History(node.NodeID, window)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("查询历史失败: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response = append(response, &nodeHistory{Stats: stats, Records: records})
+	}
+	writeJSON(w, response)
+}
+
+// handleHistoryCompare 对比 source 参数指定来源的最近两次测速，未指定时使用最近一次测速的来源
+func (s *Server) handleHistoryCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.validateAuth(r.Header.Get("Authorization")) {
+		http.Error(w, "未授权：无效的 Authorization header", http.StatusUnauthorized)
+		return
+	}
+
+	comparison, err := s.config.History.CompareLatest(r.URL.Query().Get("source"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("对比失败: %v", err), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, comparison)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
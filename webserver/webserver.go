@@ -1,50 +1,237 @@
 package webserver
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/faceair/clash-speedtest/history"
+	"github.com/faceair/clash-speedtest/speedserver"
 	"github.com/faceair/clash-speedtest/speedtester"
 	"github.com/google/uuid"
 	"gopkg.in/yaml.v3"
 )
 
+// Config 表示 Web 服务器配置
+type Config struct {
+	Addr            string        // 监听地址，例如 ":8080" 或 "127.0.0.1:8443"
+	TLSCertFile     string        // TLS 证书路径，与 TLSKeyFile 同时设置时启用 HTTPS
+	TLSKeyFile      string        // TLS 私钥路径
+	TLSReload       time.Duration // 证书自动重载检查间隔，0 表示不重载
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration // /speedtest 和测速服务器的接口不受此限制
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration  // 收到退出信号后等待正在运行的测速任务的最长时间
+	MaxBodySize     int64          // 请求体最大字节数
+	MaxNodes        int            // 单次测速允许的最大节点数，0 表示不限制
+	History         *history.Store // 非空时记录每次测速结果，并提供 /history 查询接口
+	HistoryWindow   int            // 计算稳定性评分以及 /history 默认使用的最近运行次数，默认 10
+	// SpeedServer 非空时同时提供测速服务器的接口（见 speedserver.Paths），Web 服务器的地址可直接作为 server-url 使用
+	SpeedServer *speedserver.Config
+	// SpeedServerPublic 表示测速服务器的接口不需要身份验证，否则与 /speedtest 一样需要 AUTH_KEY
+	SpeedServerPublic bool
+}
+
 // Server 表示 Web 服务器
 type Server struct {
-	authKey string
-	port    int
+	authKey      string
+	config       *Config
+	httpServer   *http.Server
+	mux          *http.ServeMux
+	jobs         sync.WaitGroup
+	jobsMu       sync.Mutex // 保证 shuttingDown 的检查和 jobs.Add 不会与 Shutdown 交错
+	shuttingDown bool
 }
 
 // New 创建一个新的 Web 服务器实例
-func New(port int) (*Server, error) {
+func New(config *Config) (*Server, error) {
 	authKey := os.Getenv("AUTH_KEY")
 	if authKey == "" {
 		return nil, fmt.Errorf("环境变量 AUTH_KEY 未设置，Web 模式需要设置此变量用于身份验证")
 	}
+	if config.Addr == "" {
+		config.Addr = ":8080"
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS 证书和私钥必须同时设置")
+	}
+	if config.ReadTimeout <= 0 {
+		config.ReadTimeout = 30 * time.Second
+	}
+	if config.HistoryWindow <= 0 {
+		config.HistoryWindow = 10
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 10 * time.Minute
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 2 * time.Minute
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 5 * time.Minute
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 10 * 1024 * 1024
+	}
 
-	return &Server{
+	s := &Server{
 		authKey: authKey,
-		port:    port,
-	}, nil
+		config:  config,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/speedtest", s.handleSpeedTest)
+	mux.HandleFunc("/health", s.handleHealth)
+	if config.History != nil {
+		mux.HandleFunc("/history", s.handleHistory)
+		mux.HandleFunc("/history/compare", s.handleHistoryCompare)
+	}
+	if config.SpeedServer != nil {
+		speedConfig := *config.SpeedServer
+		speedConfig.Token = authKey
+		if config.SpeedServerPublic {
+			speedConfig.Token = ""
+		}
+		handler := speedserver.New(&speedConfig)
+		// 测速服务器与独立的 download-server 一样不限制读写时长，大文件或慢速的上传下载不受 ReadTimeout、WriteTimeout 限制
+		for _, path := range speedserver.Paths {
+			mux.Handle(path, withoutDeadlines(handler))
+		}
+	}
+
+	s.mux = mux
+	s.httpServer = &http.Server{
+		Addr:              config.Addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	return s, nil
+}
+
+// Handle 在 Web 服务器上挂载额外的处理器（不需要身份验证），需在 Start 之前调用
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
 }
 
-// Start 启动 Web 服务器
+// Start 启动 Web 服务器，阻塞直到收到 SIGINT/SIGTERM 并完成优雅退出
 func (s *Server) Start() error {
-	http.HandleFunc("/speedtest", s.handleSpeedTest)
-	http.HandleFunc("/health", s.handleHealth)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var reloader *certReloader
+	if s.config.TLSCertFile != "" {
+		var err error
+		reloader, err = newCertReloader(s.config.TLSCertFile, s.config.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("加载 TLS 证书失败: %w", err)
+		}
+		s.httpServer.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		if s.config.TLSReload > 0 {
+			go reloader.watch(ctx, s.config.TLSReload)
+		}
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		var err error
+		if reloader != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
+		errChan <- err
+	}()
 
-	addr := fmt.Sprintf(":%d", s.port)
-	log.Printf("Web 服务器启动在端口 %d", s.port)
+	scheme := "http"
+	if reloader != nil {
+		scheme = "https"
+	}
+	log.Printf("Web 服务器启动在 %s://%s", scheme, s.config.Addr)
 	log.Printf("POST /speedtest - 执行测速（需要 Authorization header）")
 	log.Printf("GET  /health - 健康检查")
+	if s.config.History != nil {
+		log.Printf("GET  /history?node=<id 或名称> - 查询节点历史（需要 Authorization header）")
+		log.Printf("GET  /history/compare - 对比最近两次测速（需要 Authorization header）")
+	}
 
-	return http.ListenAndServe(addr, nil)
+	select {
+	case err := <-errChan:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("收到退出信号，等待正在运行的测速任务完成（最长 %v）...", s.config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
+
+// Shutdown 停止接收新请求，并等待正在运行的测速任务完成
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.jobsMu.Lock()
+	s.shuttingDown = true
+	s.jobsMu.Unlock()
+	err := s.httpServer.Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("Web 服务器已退出")
+	case <-ctx.Done():
+		log.Printf("等待测速任务超时，强制退出")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// withoutDeadlines 清除连接的读写超时后再交给 handler 处理
+func withoutDeadlines(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// startJob 在未开始退出时登记一个测速任务，返回 false 表示正在退出
+func (s *Server) startJob() bool {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.jobs.Add(1)
+	return true
 }
 
 // handleHealth 处理健康检查请求
@@ -74,9 +261,26 @@ func (s *Server) handleSpeedTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 退出过程中不再接受新任务
+	if !s.startJob() {
+		http.Error(w, "服务器正在退出", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.jobs.Done()
+
+	// 测速可能超过 WriteTimeout（节点多时），只要请求体在 ReadTimeout 内读完即可
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("清除写超时失败: %v", err)
+	}
+
 	// 读取请求体（YAML 配置）
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.config.MaxBodySize))
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("请求体超过 %d 字节限制", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, fmt.Sprintf("读取请求体失败: %v", err), http.StatusBadRequest)
 		return
 	}
@@ -94,17 +298,34 @@ func (s *Server) handleSpeedTest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 可选的筛选条件
+	options, err := parseTestOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	log.Printf("收到测速请求，配置大小: %d 字节", len(body))
 
 	// 执行测速
-	resultYAML, err := s.performSpeedTest(body)
+	resultYAML, subs, err := s.performSpeedTest(body, options)
 	if err != nil {
 		log.Printf("测速失败: %v", err)
+		if errors.Is(err, errTooManyNodes) {
+			http.Error(w, fmt.Sprintf("测速失败: %v", err), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, fmt.Sprintf("测速失败: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// 返回结果
+	// 返回结果，订阅流量信息以 subscription-userinfo 响应头透传给客户端
+	if merged := speedtester.MergeSubscriptionInfo(subs); merged != nil {
+		w.Header().Set("Subscription-Userinfo", merged.HeaderValue())
+		if merged.UpdateInterval > 0 {
+			w.Header().Set("Profile-Update-Interval", strconv.Itoa(max(int(merged.UpdateInterval.Hours()), 1)))
+		}
+	}
 	w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write(resultYAML)
@@ -127,35 +348,100 @@ func (s *Server) validateAuth(authHeader string) bool {
 	return parts[1] == s.authKey
 }
 
-// performSpeedTest 执行测速并返回结果 YAML
-func (s *Server) performSpeedTest(yamlData []byte) ([]byte, error) {
+var errTooManyNodes = errors.New("节点数量超过限制")
+
+// testOptions 是测速请求通过查询参数指定的筛选条件
+type testOptions struct {
+	filterExpr       string
+	countries        string
+	excludeCountries string
+	topPerCountry    int
+	topBy            string
+	sortBy           string
+	scoreWeights     speedtester.ScoreWeights
+	baseline         bool // 先测试直连基准，结果写在返回的 YAML 开头
+}
+
+// parseTestOptions 解析并校验 filter、countries、exclude_countries、top_per_country、top_by、sort、score_weights、baseline 查询参数
+func parseTestOptions(query url.Values) (*testOptions, error) {
+	options := &testOptions{
+		filterExpr:       query.Get("filter"),
+		countries:        query.Get("countries"),
+		excludeCountries: query.Get("exclude_countries"),
+		topBy:            query.Get("top_by"),
+		sortBy:           query.Get("sort"),
+	}
+	if _, _, err := speedtester.ParseFilter(options.filterExpr); err != nil {
+		return nil, fmt.Errorf("无效的筛选表达式: %v", err)
+	}
+	if err := speedtester.ValidateSortKey(options.topBy); err != nil {
+		return nil, fmt.Errorf("无效的 top_by: %v", err)
+	}
+	if err := speedtester.ValidateSortKey(options.sortBy); err != nil {
+		return nil, fmt.Errorf("无效的 sort: %v", err)
+	}
+	weights, err := speedtester.ParseScoreWeights(query.Get("score_weights"))
+	if err != nil {
+		return nil, fmt.Errorf("无效的 score_weights: %v", err)
+	}
+	options.scoreWeights = weights
+	if top := query.Get("top_per_country"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("无效的 top_per_country: %s", top)
+		}
+		options.topPerCountry = n
+	}
+	if v := query.Get("baseline"); v != "" {
+		baseline, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("无效的 baseline: %s", v)
+		}
+		options.baseline = baseline
+	}
+	return options, nil
+}
+
+// performSpeedTest 执行测速并返回结果 YAML 和配置中订阅的流量信息
+func (s *Server) performSpeedTest(yamlData []byte, options *testOptions) ([]byte, []*speedtester.SubscriptionInfo, error) {
 	// 创建临时文件保存配置
 	tmpFile, err := os.CreateTemp("", "speedtest-*.yaml")
 	if err != nil {
-		return nil, fmt.Errorf("创建临时文件失败: %v", err)
+		return nil, nil, fmt.Errorf("创建临时文件失败: %v", err)
 	}
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
 
 	if _, err := tmpFile.Write(yamlData); err != nil {
-		return nil, fmt.Errorf("写入临时文件失败: %v", err)
+		return nil, nil, fmt.Errorf("写入临时文件失败: %v", err)
 	}
 	tmpFile.Close()
 
 	// 使用固定的默认参数创建 SpeedTester
 	config := &speedtester.Config{
-		ConfigPaths:      tmpFile.Name(),
-		FilterRegex:      ".+",
-		BlockRegex:       "",
-		ServerURL:        "https://speed.cloudflare.com",
-		DownloadSize:     50 * 1024 * 1024,
-		UploadSize:       20 * 1024 * 1024,
-		Timeout:          2 * time.Second,
-		Concurrent:       100,
-		MaxLatency:       5000 * time.Millisecond,
-		MinDownloadSpeed: 0,
-		MinUploadSpeed:   0,
-		FastMode:         true, // 快速模式，仅测试延迟
+		ConfigPaths:          tmpFile.Name(),
+		FilterRegex:          ".+",
+		BlockRegex:           "",
+		ServerURL:            "https://speed.cloudflare.com",
+		DownloadSize:         50 * 1024 * 1024,
+		UploadSize:           20 * 1024 * 1024,
+		Timeout:              2 * time.Second,
+		Concurrent:           100,
+		MaxLatency:           5000 * time.Millisecond,
+		MinDownloadSpeed:     0,
+		MinUploadSpeed:       0,
+		FastMode:             true, // 快速模式，仅测试延迟
+		DisableFileProviders: true, // 上传的配置不允许读取服务器上的文件
+		FilterExpr:           options.filterExpr,
+		Countries:            options.countries,
+		ExcludeCountries:     options.excludeCountries,
+		TopPerCountry:        options.topPerCountry,
+		TopBy:                options.topBy,
+		SortBy:               options.sortBy,
+		ScoreWeights:         &options.scoreWeights,
+	}
+	if s.config.History != nil {
+		config.Stability = s.config.History.Stability(s.config.HistoryWindow)
 	}
 
 	tester := speedtester.New(config)
@@ -163,16 +449,27 @@ func (s *Server) performSpeedTest(yamlData []byte) ([]byte, error) {
 	// 加载代理
 	allProxies, err := tester.LoadProxies(false)
 	if err != nil {
-		return nil, fmt.Errorf("加载代理失败: %v", err)
+		return nil, nil, fmt.Errorf("加载代理失败: %v", err)
 	}
 
 	if len(allProxies) == 0 {
-		return nil, fmt.Errorf("配置中没有找到可用的代理节点")
+		return nil, nil, fmt.Errorf("配置中没有找到可用的代理节点")
+	}
+
+	if s.config.MaxNodes > 0 && len(allProxies) > s.config.MaxNodes {
+		return nil, nil, fmt.Errorf("%w: %d > %d", errTooManyNodes, len(allProxies), s.config.MaxNodes)
 	}
 
-	log.Printf("加载了 %d 个代理节点，开始测速...", len(allProxies))
+	log.Printf("加载了 %d 个代理节点（合并重复节点 %d 个），开始测速...", len(allProxies), tester.DuplicateCount())
+
+	var baseline *speedtester.Result
+	if options.baseline {
+		baseline = tester.TestBaseline()
+		log.Printf("直连基准: 延迟 %s", baseline.FormatLatency())
+	}
 
 	// 执行测速
+	startedAt := time.Now()
 	results := make([]*speedtester.Result, 0)
 	var mu sync.Mutex
 
@@ -183,37 +480,85 @@ func (s *Server) performSpeedTest(yamlData []byte) ([]byte, error) {
 		log.Printf("测试完成: %s - 延迟: %s", result.ProxyName, result.FormatLatency())
 	})
 
+	sent, received := tester.TrafficUsed()
+	log.Printf("测速共消耗流量 %s", speedtester.FormatBytes(sent+received))
+
+	if s.config.History != nil {
+		if _, err := s.config.History.SaveRun(startedAt, webSource(yamlData), results); err != nil {
+			log.Printf("保存测速历史失败: %v", err)
+		}
+	}
+
 	// 过滤和处理结果
-	validResults := filterResults(results, config)
+	tester.SortResults(results)
+	validResults := tester.SelectTopPerCountry(filterResults(results, config, tester))
 	log.Printf("过滤后剩余 %d 个有效节点", len(validResults))
 
 	//if len(validResults) == 0 {
-	//	return nil, fmt.Errorf("没有符合条件的节点（延迟 < %v）", config.MaxLatency)
+	//	return nil, nil, fmt.Errorf("没有符合条件的节点（延迟 < %v）", config.MaxLatency)
 	//}
 
 	// 重命名节点
 	renameNodes(validResults, tester, config.Concurrent)
 
 	// 生成输出 YAML
-	proxies := make([]map[string]any, 0)
-	for _, result := range validResults {
-		proxies = append(proxies, result.ProxyConfig)
-	}
+	proxies := speedtester.OutputProxies(validResults)
 
 	outputConfig := &speedtester.RawConfig{
-		Proxies: proxies,
+		Proxies:     proxies,
+		ProxyGroups: speedtester.BuildProxyGroups(tester.Groups(), validResults),
 	}
 
 	yamlOutput, err := yaml.Marshal(outputConfig)
 	if err != nil {
-		return nil, fmt.Errorf("生成 YAML 失败: %v", err)
+		return nil, nil, fmt.Errorf("生成 YAML 失败: %v", err)
 	}
 
-	return yamlOutput, nil
+	// 在 YAML 开头以注释写明直连基准、各 provider 的测试情况、剩余流量和到期时间
+	var header strings.Builder
+	if baseline != nil {
+		fmt.Fprintf(&header, "# 直连基准 延迟: %s\n", baseline.FormatLatency())
+		for _, issue := range tester.BaselineIssues(baseline) {
+			fmt.Fprintf(&header, "# warning: %s，节点的测试结果可能受本地网络限制\n", issue)
+		}
+	}
+	for _, summary := range tester.SummarizeSources(results) {
+		if summary.Provider == "" && summary.Loaded == 0 && summary.ParseFailed == 0 && summary.Error == "" {
+			continue
+		}
+		name := summary.Provider
+		if name == "" {
+			name = "proxies"
+		}
+		if summary.Error != "" {
+			fmt.Fprintf(&header, "# 来源 %s 加载失败: %s\n", name, summary.Error)
+			continue
+		}
+		fmt.Fprintf(&header, "# 来源 %s 加载: %d 解析失败: %d 已测试: %d 通过: %d 延迟中位数: %dms\n",
+			name, summary.Loaded, summary.ParseFailed, summary.Tested, summary.Passed, summary.MedianLatency.Milliseconds())
+	}
+	subs := tester.Subscriptions()
+	for _, sub := range subs {
+		remaining, expire := "N/A", "长期有效"
+		if r := sub.Remaining(); r >= 0 {
+			remaining = speedtester.FormatBytes(r)
+		}
+		if !sub.Expire.IsZero() {
+			expire = sub.Expire.Format(time.DateOnly)
+		}
+		// 上传的配置保存在临时文件中，只有 provider 会产生订阅信息，以 provider 名称标识
+		fmt.Fprintf(&header, "# 订阅 %s 剩余流量: %s 到期时间: %s\n", sub.Provider, remaining, expire)
+		for _, warning := range sub.Warnings(time.Now()) {
+			log.Printf("订阅 %s: %s", sub.Provider, warning)
+			fmt.Fprintf(&header, "# warning: %s\n", warning)
+		}
+	}
+
+	return append([]byte(header.String()), yamlOutput...), subs, nil
 }
 
 // filterResults 过滤测速结果
-func filterResults(results []*speedtester.Result, config *speedtester.Config) []*speedtester.Result {
+func filterResults(results []*speedtester.Result, config *speedtester.Config, tester *speedtester.SpeedTester) []*speedtester.Result {
 	var validResults []*speedtester.Result
 
 	for _, result := range results {
@@ -227,6 +572,16 @@ func filterResults(results []*speedtester.Result, config *speedtester.Config) []
 			continue
 		}
 
+		// relay 策略组不能作为节点输出
+		if result.IsRelay() {
+			continue
+		}
+
+		// 筛选表达式中依赖测试结果的部分和国家筛选
+		if !tester.Passed(result) {
+			continue
+		}
+
 		validResults = append(validResults, result)
 	}
 
@@ -294,3 +649,9 @@ func getCountryName(code string) string {
 	}
 	return "未知"
 }
+
+// webSource 返回上传的配置写入历史时的来源，相同内容的配置对应相同的来源
+func webSource(yamlData []byte) string {
+	sum := sha256.Sum256(yamlData)
+	return "web:" + hex.EncodeToString(sum[:8])
+}